@@ -0,0 +1,208 @@
+package main
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leafValidity is how long a minted leaf certificate is valid for.
+// Clients such as Safari reject server certificates valid for more than 398 days.
+const leafValidity = 365 * 24 * time.Hour
+
+// leafRenewal is how long before a cached leaf expires that a new one is minted,
+// so no client is handed a certificate about to lapse mid-connection
+const leafRenewal = 24 * time.Hour
+
+// maxCachedLeaves bounds the leaf cache; the least recently used leaf is dropped beyond it
+const maxCachedLeaves = 1024
+
+// CertAuthority signs per-host leaf certificates using the NetMiddler CA
+type CertAuthority struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	leafKey *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	cache map[string]*list.Element // of *cachedLeaf, by host
+	lru   *list.List               // most recently used first
+}
+
+type cachedLeaf struct {
+	host string
+	cert *tls.Certificate
+}
+
+// loadCA loads the CA certificate and private key created by createCACert
+func loadCA(certFile, keyFile string) (*CertAuthority, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA private key type %T", pair.PrivateKey)
+	}
+	return newCertAuthority(cert, key)
+}
+
+// newUntrustedCA creates a throwaway CA which exists only in memory, so nothing
+// trusts the certificates it signs. These stand in for upstream certificates
+// which failed verification, so the client still sees that there is a problem.
+func newUntrustedCA() (*CertAuthority, error) {
+	const commonName = "DO_NOT_TRUST_NetMiddler_Upstream_Verification_Failed"
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate key: %v", err)
+	}
+	now := time.Now()
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{commonName}},
+		NotBefore:             now.Add(-time.Hour).UTC(),
+		NotAfter:              now.Add(leafValidity).UTC(),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create untrusted CA cert: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return newCertAuthority(cert, key)
+}
+
+func newCertAuthority(cert *x509.Certificate, key crypto.Signer) (*CertAuthority, error) {
+	// All leaves share a single key; generating one per host is slow and buys nothing here
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate leaf key: %v", err)
+	}
+
+	return &CertAuthority{
+		cert:    cert,
+		key:     key,
+		leafKey: leafKey,
+		cache:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+// CertFor returns a leaf certificate for host, signing a new one if none is cached
+// or the cached one is about to expire. The host may carry a port, which is ignored.
+func (ca *CertAuthority) CertFor(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(hostOnly(host))
+	if host == "" {
+		return nil, fmt.Errorf("no host name to issue a certificate for")
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if e, ok := ca.cache[host]; ok {
+		if cert := e.Value.(*cachedLeaf).cert; time.Now().Add(leafRenewal).Before(cert.Leaf.NotAfter) {
+			ca.lru.MoveToFront(e)
+			return cert, nil
+		}
+		ca.lru.Remove(e)
+		delete(ca.cache, host)
+	}
+	cert, err := ca.sign(host)
+	if err != nil {
+		return nil, err
+	}
+	ca.cache[host] = ca.lru.PushFront(&cachedLeaf{host: host, cert: cert})
+	if ca.lru.Len() > maxCachedLeaves {
+		oldest := ca.lru.Back()
+		ca.lru.Remove(oldest)
+		delete(ca.cache, oldest.Value.(*cachedLeaf).host)
+	}
+	return cert, nil
+}
+
+// TLSConfig returns a server tls.Config which presents a leaf for the SNI name,
+// falling back to defaultHost when the client sends no SNI (e.g. IP literals)
+func (ca *CertAuthority) TLSConfig(defaultHost string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return ca.CertFor(hello.ServerName)
+			}
+			return ca.CertFor(defaultHost)
+		},
+	}
+}
+
+func (ca *CertAuthority) sign(host string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	// Backdate slightly to tolerate clock skew between us and the client
+	now := time.Now()
+	notAfter := now.Add(leafValidity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: ca.cert.Subject.Organization},
+		NotBefore:             now.Add(-time.Hour).UTC(),
+		NotAfter:              notAfter.UTC(),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, ca.cert, ca.leafKey.Public(), ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate for %s: %v", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate for %s: %v", host, err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+// hostOnly strips an optional port and IPv6 brackets from hostport
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.Trim(hostport, "[]")
+}
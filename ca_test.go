@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCertForSANs(t *testing.T) {
+	ca, err := newUntrustedCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		host string
+		dns  string
+		ip   string
+	}{
+		{host: "example.com", dns: "example.com"},
+		{host: "WWW.Example.com:443", dns: "www.example.com"},
+		{host: "10.0.0.1", ip: "10.0.0.1"},
+		{host: "10.0.0.1:8443", ip: "10.0.0.1"},
+		{host: "[2001:db8::1]:443", ip: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		cert, err := ca.CertFor(tt.host)
+		if err != nil {
+			t.Fatalf("CertFor(%q): %v", tt.host, err)
+		}
+		leaf := cert.Leaf
+		name := tt.dns
+		if tt.dns != "" {
+			if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != tt.dns || len(leaf.IPAddresses) != 0 {
+				t.Errorf("CertFor(%q) has DNS names %v and IPs %v, want DNS name %s", tt.host, leaf.DNSNames, leaf.IPAddresses, tt.dns)
+			}
+		} else {
+			name = tt.ip
+			if len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP(tt.ip)) || len(leaf.DNSNames) != 0 {
+				t.Errorf("CertFor(%q) has DNS names %v and IPs %v, want IP %s", tt.host, leaf.DNSNames, leaf.IPAddresses, tt.ip)
+			}
+		}
+
+		// The chain sent to clients verifies against the CA alone
+		intermediates := x509.NewCertPool()
+		for _, der := range cert.Certificate[1:] {
+			c, _ := x509.ParseCertificate(der)
+			intermediates.AddCert(c)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: intermediates}); err != nil {
+			t.Errorf("certificate for %q doesn't verify: %v", tt.host, err)
+		}
+		if leaf.NotAfter.After(ca.cert.NotAfter) {
+			t.Errorf("certificate for %q outlives its CA", tt.host)
+		}
+	}
+
+	if _, err := ca.CertFor(""); err == nil {
+		t.Error("issued a certificate for no host")
+	}
+}
+
+func TestCertForCache(t *testing.T) {
+	ca, err := newUntrustedCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := ca.CertFor("example.com")
+	if again, _ := ca.CertFor("EXAMPLE.com:443"); again != first {
+		t.Error("the cached certificate wasn't reused")
+	}
+
+	// A leaf close to expiring is replaced
+	first.Leaf.NotAfter = time.Now().Add(leafRenewal / 2)
+	if renewed, _ := ca.CertFor("example.com"); renewed == first {
+		t.Error("a certificate about to expire was reused")
+	}
+
+	// Beyond maxCachedLeaves, the least recently used leaf goes
+	keep, _ := ca.CertFor("keep.test")
+	for i := 0; i < maxCachedLeaves; i++ {
+		if i%100 == 0 {
+			ca.CertFor("keep.test")
+		}
+		if _, err := ca.CertFor(fmt.Sprintf("host%d.test", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ca.cache) != maxCachedLeaves || ca.lru.Len() != maxCachedLeaves {
+		t.Errorf("cache holds %d (%d listed), want %d", len(ca.cache), ca.lru.Len(), maxCachedLeaves)
+	}
+	if _, ok := ca.cache["example.com"]; ok {
+		t.Error("the least recently used leaf was kept")
+	}
+	if again, _ := ca.CertFor("keep.test"); again != keep {
+		t.Error("a recently used leaf was evicted")
+	}
+}
+
+func TestTLSConfigDefaultHost(t *testing.T) {
+	ca, err := newUntrustedCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ca.TLSConfig("10.0.0.1:443")
+	for serverName, want := range map[string]string{"example.com": "example.com", "": "10.0.0.1"} {
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cert.Leaf.Subject.CommonName; got != want {
+			t.Errorf("SNI %q got a certificate for %s, want %s", serverName, got, want)
+		}
+	}
+}
@@ -14,9 +14,12 @@ import (
 	"github.com/smallstep/truststore"
 )
 
-func ensureCACert(uninstall bool) error {
-	const caCertFile = "netmiddler.pem"
+const (
+	caCertFile = "netmiddler.pem"
+	caKeyFile  = "netmiddler_pk.pem"
+)
 
+func ensureCACert(uninstall bool) error {
 	if uninstall {
 		if err := truststore.UninstallFile(caCertFile, truststore.WithJava(), truststore.WithFirefox()); err != nil {
 			//todo:  truststore seems to return errors here despite removing certs on Windows
@@ -42,6 +45,16 @@ func ensureCACert(uninstall bool) error {
 	return nil
 }
 
+// ensureCACertFile creates the CA certificate if needed, without installing it
+// into any trust store
+func ensureCACertFile() error {
+	if _, err := os.Stat(caCertFile); err == nil {
+		return nil
+	}
+	fmt.Println("Create CA Cert")
+	return createCACert(caCertFile)
+}
+
 func createCACert(caCertFile string) error {
 	const org = "DO_NOT_TRUST_NetMiddlerRoot"
 	const commonName = "DO_NOT_TRUST_NetMiddlerRoot"
@@ -67,7 +80,7 @@ func createCACert(caCertFile string) error {
 		return fmt.Errorf("failed to create CA cert for apiserver %v", err)
 	}
 	// Save the certificate to a PEM file
-	certOut, err := os.Create("netmiddler.pem")
+	certOut, err := os.Create(caCertFile)
 	if err != nil {
 		return fmt.Errorf("failed to open proxy-cert.pem for writing: %v", err)
 	}
@@ -78,7 +91,7 @@ func createCACert(caCertFile string) error {
 	}
 
 	// Save the private key to a PEM file
-	keyOut, err := os.Create("netmiddler_pk.pem")
+	keyOut, err := os.Create(caKeyFile)
 	if err != nil {
 		return fmt.Errorf("failed to open proxy-key.pem for writing: %v", err)
 	}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// errProxyLoop is returned when the proxy is asked to connect to itself
+var errProxyLoop = errors.New("proxy loop detected: refusing to connect to NetMiddler's own listen address")
+
+// proxyConfig is what newProxy builds a Proxy from; main fills it from the command line
+type proxyConfig struct {
+	port int
+
+	upstreamCAFile string
+	insecureHosts  string
+	verifyFailure  string
+
+	upstreamProxy       string
+	upstreamProxyBypass string
+	socksAuth           string
+
+	interceptHosts   string
+	passthroughHosts string
+	detectPinning    bool
+
+	forwardingHeaders string
+
+	maxSessions      int
+	maxSessionBytes  int64
+	sessionBodyLimit int
+	harPath          string
+	importHARPath    string
+	sazPath          string
+	importSAZPath    string
+
+	upstreamMaxIdle     int
+	upstreamIdleTimeout time.Duration
+
+	timeouts timeouts
+}
+
+// newProxy creates a Proxy listening on cfg.port, whose upstream connections are
+// all made through dialContext
+func newProxy(ca *CertAuthority, cfg proxyConfig) (*Proxy, error) {
+	if cfg.verifyFailure != verifyFailureUntrusted && cfg.verifyFailure != verifyFailureError {
+		return nil, fmt.Errorf("unknown -verify-failure %q", cfg.verifyFailure)
+	}
+	untrustedCA, err := newUntrustedCA()
+	if err != nil {
+		return nil, err
+	}
+	upstreamRoots, err := loadUpstreamRoots(cfg.upstreamCAFile)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := parseParentProxy(cfg.upstreamProxy)
+	if err != nil {
+		return nil, err
+	}
+	socksUser, socksPassword, err := parseSOCKSAuth(cfg.socksAuth)
+	if err != nil {
+		return nil, err
+	}
+	forwarding, err := parseForwardingHeaders(cfg.forwardingHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		ca:            ca,
+		port:          cfg.port,
+		untrustedCA:   untrustedCA,
+		upstreamRoots: upstreamRoots,
+		insecureHosts: parseHostList(cfg.insecureHosts),
+		verifyFailure: cfg.verifyFailure,
+		policy:        newTLSPolicy(cfg.interceptHosts, cfg.passthroughHosts, cfg.detectPinning),
+		parentProxy:   parent,
+		parentBypass:  parseHostList(cfg.upstreamProxyBypass),
+		socksUser:     socksUser,
+		socksPassword: socksPassword,
+		forwarding:    forwarding,
+		sessions:      newSessionStore(cfg.maxSessions, cfg.maxSessionBytes, cfg.sessionBodyLimit),
+		timeouts:      cfg.timeouts,
+		sazPath:       cfg.sazPath,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = p.dialTransport
+	transport.TLSHandshakeTimeout = p.timeouts.tlsHandshake
+	transport.ResponseHeaderTimeout = p.timeouts.responseHeader
+	// Bodies are relayed as the server sent them, rather than decompressed
+	transport.DisableCompression = true
+	// The environment's proxy variables may well point back at us
+	transport.Proxy = p.transportProxy
+	p.transport = transport
+	p.pool = newUpstreamPool(p, cfg.upstreamMaxIdle, cfg.upstreamIdleTimeout)
+	if err := p.setupHAR(cfg.importHARPath, cfg.harPath); err != nil {
+		return nil, err
+	}
+	if err := p.setupSAZ(cfg.importSAZPath, cfg.sazPath); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// dialContext connects to the target server or parent proxy. When markSockets is set, upstream
+// sockets are marked so the firewall rules don't redirect them back to the proxy
+// (see markSocket). Connections to the proxy's own listen address are refused.
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: p.timeouts.dial,
+		Control: func(network, address string, c syscall.RawConn) error {
+			// address is resolved by now, so host names pointing back at us are caught too
+			if p.isListenAddr(address) {
+				return errProxyLoop
+			}
+			if !p.markSockets {
+				return nil
+			}
+			var err error
+			if ctrlErr := c.Control(func(fd uintptr) { err = markSocket(fd) }); ctrlErr != nil {
+				return ctrlErr
+			}
+			return err
+		},
+	}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	return conn, asTimeout(err, phaseDial, p.timeouts.dial)
+}
+
+// newServer returns the http.Server for a listener of the proxy, with the client
+// side timeouts applied
+func (p *Proxy) newServer() *http.Server {
+	return &http.Server{
+		Handler:           p,
+		ConnContext:       connContext,
+		ReadHeaderTimeout: p.timeouts.idle,
+		IdleTimeout:       p.timeouts.idle,
+	}
+}
+
+// isListenAddr reports whether address (ip:port) reaches one of the proxy's own listeners
+func (p *Proxy) isListenAddr(address string) bool {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if port, err := strconv.Atoi(portStr); err != nil || (port != p.port && (p.socksPort == 0 || port != p.socksPort)) {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	// The proxy listens on all interfaces
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamErrorStatus is the status reported to the client when the target server
+// can't be reached
+func upstreamErrorStatus(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errProxyLoop):
+		return http.StatusLoopDetected
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -216,7 +216,10 @@ import "C"
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"os/exec"
 	"strconv"
+	"strings"
 	"unsafe"
 )
 
@@ -240,7 +243,10 @@ func disableProxy() error {
 	return nil
 }
 
-func enableProxy(port int) error {
+func enableProxy(port int, scope interceptScope) error {
+	if !scope.IsZero() {
+		return errScopeUnsupported
+	}
 
 	chost := C.CString("localhost")
 	cport := C.CString(strconv.Itoa(port))
@@ -261,3 +267,116 @@ func enableProxy(port int) error {
 	}
 	return nil
 }
+
+// systemState holds the web proxy settings of each network service, as reported
+// by networksetup, so they can be put back exactly rather than just switched off
+type systemState struct {
+	Services []serviceProxies `json:"services"`
+}
+
+// serviceProxies is the HTTP and HTTPS proxy configuration of one network service
+type serviceProxies struct {
+	Name   string        `json:"name"`
+	Web    proxySettings `json:"web"`
+	Secure proxySettings `json:"secure"`
+}
+
+type proxySettings struct {
+	Enabled bool   `json:"enabled"`
+	Server  string `json:"server,omitempty"`
+	Port    int    `json:"port,omitempty"`
+}
+
+func captureSystemState() (systemState, error) {
+	var state systemState
+	services, err := networkServices()
+	if err != nil {
+		return state, err
+	}
+	for _, name := range services {
+		web, err := getProxySettings("-getwebproxy", name)
+		if err != nil {
+			return state, err
+		}
+		secure, err := getProxySettings("-getsecurewebproxy", name)
+		if err != nil {
+			return state, err
+		}
+		state.Services = append(state.Services, serviceProxies{Name: name, Web: web, Secure: secure})
+	}
+	return state, nil
+}
+
+func restoreSystemState(state systemState) error {
+	// Switch everything off first: services missing from the state, such as one
+	// added while the proxy ran, shouldn't be left pointing at it
+	if err := disableProxy(); err != nil {
+		return err
+	}
+	var errs []error
+	for _, service := range state.Services {
+		errs = append(errs,
+			setProxySettings("-setwebproxy", "-setwebproxystate", service.Name, service.Web),
+			setProxySettings("-setsecurewebproxy", "-setsecurewebproxystate", service.Name, service.Secure))
+	}
+	return errors.Join(errs...)
+}
+
+// networkServices lists the enabled network services by name
+func networkServices() ([]string, error) {
+	out, err := exec.Command("networksetup", "-listallnetworkservices").Output()
+	if err != nil {
+		return nil, fmt.Errorf("networksetup -listallnetworkservices: %v", err)
+	}
+	var services []string
+	// The first line explains that disabled services are marked with an asterisk
+	for _, line := range strings.Split(string(out), "\n")[1:] {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "*") {
+			services = append(services, line)
+		}
+	}
+	return services, nil
+}
+
+// getProxySettings parses the "Enabled:", "Server:" and "Port:" lines networksetup prints
+func getProxySettings(flag, service string) (proxySettings, error) {
+	var settings proxySettings
+	out, err := exec.Command("networksetup", flag, service).Output()
+	if err != nil {
+		return settings, fmt.Errorf("networksetup %s %q: %v", flag, service, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Enabled":
+			settings.Enabled = value == "Yes"
+		case "Server":
+			settings.Server = value
+		case "Port":
+			settings.Port, _ = strconv.Atoi(value)
+		}
+	}
+	return settings, nil
+}
+
+func setProxySettings(setFlag, stateFlag, service string, settings proxySettings) error {
+	if settings.Server != "" {
+		out, err := exec.Command("networksetup", setFlag, service, settings.Server, strconv.Itoa(settings.Port)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("networksetup %s %q: %v: %s", setFlag, service, err, out)
+		}
+	}
+	state := "off"
+	if settings.Enabled {
+		state = "on"
+	}
+	out, err := exec.Command("networksetup", stateFlag, service, state).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("networksetup %s %q: %v: %s", stateFlag, service, err, out)
+	}
+	return nil
+}
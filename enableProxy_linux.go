@@ -2,78 +2,96 @@ package main
 
 import (
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
 	"golang.org/x/sys/unix"
 )
 
-var savedRules []*nftables.Rule
+// nftTableName is the nftables table owned by NetMiddler; nothing outside it is modified
+const nftTableName = "netmiddler"
 
-func enableProxy(port int) error {
-	conn := &nftables.Conn{}
-
-	// Get the current table and chain for the NAT table
-	natTable := &nftables.Table{
-		Family: nftables.TableFamilyIPv4,
-		Name:   "nat",
+// netmiddlerTable covers both IPv4 and IPv6 traffic
+func netmiddlerTable() *nftables.Table {
+	return &nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   nftTableName,
 	}
+}
 
-	// List rules in the 'OUTPUT' chain
-	chain := &nftables.Chain{
-		Table: natTable,
-		Name:  "OUTPUT",
-	}
-	var err error
-	savedRules, err = c.GetRules(chain)
+// enableProxy redirects HTTP/S traffic within scope to the proxy port
+func enableProxy(port int, scope interceptScope) error {
+	matches, err := scopeExprs(scope)
 	if err != nil {
 		return err
 	}
-
-	return SetProxyRules(conn, uint16(port))
+	conn := &nftables.Conn{}
+	return SetProxyRules(conn, uint16(port), matches)
 }
 
-// disableProxy restores the saved iptables state
+// disableProxy deletes the netmiddler table, leaving all other rules untouched
 func disableProxy() error {
 	c := &nftables.Conn{}
+	table := netmiddlerTable()
 
-	// First, flush the chain to remove existing rules
-	c.FlushChain(&nftables.Chain{
-		Table: &nftables.Table{
-			Family: nftables.TableFamilyIPv4,
-			Name:   "nat",
-		},
-		Name: "OUTPUT",
-	})
+	// Adding first makes the delete succeed even if the table is already gone
+	c.AddTable(table)
+	c.DelTable(table)
+	return c.Flush()
+}
 
-	// Re-add the saved rules
-	for _, rule := range savedRules {
-		c.AddRule(rule)
-	}
+// systemState needs no snapshot on Linux, since NetMiddler only ever adds its own
+// table; restoring means deleting that table
+type systemState struct {
+	Table string `json:"table"`
+}
 
-	// Commit the restored rules
-	return c.Flush()
+func captureSystemState() (systemState, error) {
+	return systemState{Table: nftTableName}, nil
 }
 
-// SetProxyRules sets iptables rules for HTTP/S proxy redirection
-func SetProxyRules(c *nftables.Conn, proxyPort uint16) error {
-	natTable := &nftables.Table{
-		Family: nftables.TableFamilyIPv4,
-		Name:   "nat",
-	}
+func restoreSystemState(state systemState) error {
+	return disableProxy()
+}
+
+// SetProxyRules creates the netmiddler table with rules redirecting HTTP/S to the proxy,
+// restricted to packets which also satisfy matches.
+// The whole table is replaced in a single transaction, so it is never half-configured.
+func SetProxyRules(c *nftables.Conn, proxyPort uint16, matches []expr.Any) error {
+	table := netmiddlerTable()
+
+	// Adding before deleting ensures the delete succeeds even when no table
+	// was left behind by a previous run
+	c.AddTable(table)
+	c.DelTable(table)
+	c.AddTable(table)
+
 	accept := nftables.ChainPolicyAccept
-	chain := &nftables.Chain{
-		Table:    natTable,
-		Name:     "OUTPUT",
+	chain := c.AddChain(&nftables.Chain{
+		Table:    table,
+		Name:     "output",
 		Type:     nftables.ChainTypeNAT,
 		Hooknum:  nftables.ChainHookOutput,
 		Priority: nftables.ChainPriorityNATDest,
 		Policy:   &accept,
-	}
+	})
+
+	// NetMiddler's own upstream connections must not be redirected back to itself
+	c.AddRule(exemptMarkRule(chain, upstreamMark))
+
+	// HTTP (port 80) and HTTPS (port 443) redirection
+	c.AddRule(redirectRule(chain, 80, proxyPort, matches))
+	c.AddRule(redirectRule(chain, 443, proxyPort, matches))
 
-	// HTTP (port 80) redirection
-	rule := &nftables.Rule{
+	// Commit the changes
+	return c.Flush()
+}
+
+// redirectRule is equivalent to `<matches> tcp dport <port> redirect to :<proxyPort>`
+func redirectRule(chain *nftables.Chain, port, proxyPort uint16, matches []expr.Any) *nftables.Rule {
+	return &nftables.Rule{
 		Table: chain.Table,
 		Chain: chain,
-		Exprs: []expr.Any{
+		Exprs: append(append([]expr.Any{}, matches...),
 			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
 			&expr.Cmp{
 				Op:       expr.CmpOpEq,
@@ -89,50 +107,33 @@ func SetProxyRules(c *nftables.Conn, proxyPort uint16) error {
 			&expr.Cmp{
 				Op:       expr.CmpOpEq,
 				Register: 1,
-				Data:     []byte{0, 80}, // Port 80
+				Data:     binaryutil.BigEndian.PutUint16(port),
 			},
 			&expr.Immediate{
 				Register: 1,
-				Data:     []byte{0, byte(proxyPort)}, // Redirect to proxy port
+				Data:     binaryutil.BigEndian.PutUint16(proxyPort),
 			},
-		},
+			&expr.Redir{
+				RegisterProtoMin: 1, // Redirect to the proxy port on the local host
+			},
+		),
 	}
+}
 
-	// Add the rule to iptables
-	c.AddRule(rule)
-
-	// HTTPS (port 443) redirection
-	ruleHTTPS := &nftables.Rule{
+// exemptMarkRule is equivalent to `meta mark <mark> accept`, which ends
+// processing of the chain before any redirect rules are reached
+func exemptMarkRule(chain *nftables.Chain, mark uint32) *nftables.Rule {
+	return &nftables.Rule{
 		Table: chain.Table,
 		Chain: chain,
 		Exprs: []expr.Any{
-			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
-				Data:     []byte{unix.IPPROTO_TCP},
-			},
-			&expr.Payload{
-				DestRegister: 1,
-				Base:         expr.PayloadBaseTransportHeader,
-				Offset:       2, // Destination port offset in TCP header
-				Len:          2,
-			},
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
 			&expr.Cmp{
 				Op:       expr.CmpOpEq,
 				Register: 1,
-				Data:     []byte{1, 187}, // Port 443
-			},
-			&expr.Immediate{
-				Register: 1,
-				Data:     []byte{0, byte(proxyPort)}, // Redirect to proxy port
+				Data:     binaryutil.NativeEndian.PutUint32(mark),
 			},
+			&expr.Verdict{Kind: expr.VerdictAccept},
 		},
 	}
-
-	// Add the rule to iptables
-	c.AddRule(ruleHTTPS)
-
-	// Commit the changes
-	return c.Flush()
 }
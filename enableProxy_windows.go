@@ -3,6 +3,7 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log"
 	"strconv"
@@ -12,21 +13,84 @@ import (
 	"golang.org/x/sys/windows/registry"
 )
 
-func enableProxy(port int) error {
+func enableProxy(port int, scope interceptScope) error {
+	if !scope.IsZero() {
+		return errScopeUnsupported
+	}
 	addrPort := "localhost:" + strconv.Itoa(port)
-	setWinInetProxy(addrPort)
-	setWinEnvProxy(addrPort)
-	return nil
+	setWinInetProxy(winInetSettings{Proxy: addrPort})
+	return setWinEnvProxy(addrPort)
+}
+
+func disableProxy() error {
+	setWinInetProxy(winInetSettings{})
+	return setWinEnvProxy("")
+}
+
+// winInetSettings holds the per-connection options applied by setWinInetProxy
+type winInetSettings struct {
+	Proxy      string `json:"proxy,omitempty"`
+	Exceptions string `json:"exceptions,omitempty"`
+	AutoConfig string `json:"autoConfig,omitempty"`
+	AutoDetect bool   `json:"autoDetect,omitempty"`
+}
+
+// systemState is the WinInet proxy configuration and http_proxy variable before enableProxy
+type systemState struct {
+	WinInet      winInetSettings `json:"winInet"`
+	HTTPProxy    string          `json:"httpProxy,omitempty"`
+	HTTPProxySet bool            `json:"httpProxySet"`
+}
+
+const internetSettingsKey = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// captureSystemState reads the current settings from the registry, where WinInet persists them
+func captureSystemState() (systemState, error) {
+	var state systemState
+
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.QUERY_VALUE)
+	if err != nil {
+		return state, err
+	}
+	defer k.Close()
+
+	if enabled, _, err := k.GetIntegerValue("ProxyEnable"); err == nil && enabled != 0 {
+		state.WinInet.Proxy, _, _ = k.GetStringValue("ProxyServer")
+	}
+	state.WinInet.Exceptions, _, _ = k.GetStringValue("ProxyOverride")
+	state.WinInet.AutoConfig, _, _ = k.GetStringValue("AutoConfigURL")
+
+	// The connection flags are a DWORD at offset 8 of the binary DefaultConnectionSettings
+	connKey, err := registry.OpenKey(k, "Connections", registry.QUERY_VALUE)
+	if err == nil {
+		defer connKey.Close()
+		if blob, _, err := connKey.GetBinaryValue("DefaultConnectionSettings"); err == nil && len(blob) >= 12 {
+			state.WinInet.AutoDetect = binary.LittleEndian.Uint32(blob[8:12])&PROXY_TYPE_AUTO_DETECT != 0
+		}
+	}
+
+	envKey, err := registry.OpenKey(registry.CURRENT_USER, envText, registry.QUERY_VALUE)
+	if err != nil {
+		return state, err
+	}
+	defer envKey.Close()
+	if value, _, err := envKey.GetStringValue("http_proxy"); err == nil {
+		state.HTTPProxy, state.HTTPProxySet = value, true
+	}
+
+	return state, nil
 }
 
-func disableProxy() {
-	setWinInetProxy("")
-	setWinEnvProxy("")
+func restoreSystemState(state systemState) error {
+	setWinInetProxy(state.WinInet)
+	if !state.HTTPProxySet {
+		return setWinEnvProxy("")
+	}
+	return setWinEnvProxy(state.HTTPProxy)
 }
 
-func setWinInetProxy(proxy string) bool {
-	var exceptions, autoconfig string
-	var autodetect bool
+func setWinInetProxy(settings winInetSettings) bool {
+	proxy, exceptions, autoconfig, autodetect := settings.Proxy, settings.Exceptions, settings.AutoConfig, settings.AutoDetect
 	options := [4]InternetConnectionOption{}
 	options[0].Option = INTERNET_PER_CONN_FLAGS
 	options[1].Option = INTERNET_PER_CONN_PROXY_SERVER
@@ -113,7 +177,7 @@ func setWinEnvProxy(value string) error {
 	k, err := registry.OpenKey(registry.CURRENT_USER, `Environment`, registry.SET_VALUE)
 	if err != nil {
 		log.Printf("%v\n", k)
-		log.Fatal(err)
+		return err
 	}
 	defer k.Close()
 
@@ -124,7 +188,7 @@ func setWinEnvProxy(value string) error {
 		fmt.Printf("Setting http_proxy environment variable = %s\n", value)
 		err = k.SetStringValue("http_proxy", value)
 	}
-	if err != nil {
+	if err != nil && !(value == "" && err == registry.ErrNotExist) {
 		fmt.Println("SetProxyEnvVar ERROR!!!")
 	}
 
@@ -139,4 +203,5 @@ func setWinEnvProxy(value string) error {
 	// 	fmt.Printf("UpdateEnvPath ERROR!!! %v %v ??!\n", ret, err)
 	// 	log.Fatal(err)
 	// }
+	return nil
 }
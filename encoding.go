@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// bodyDecoder undoes one content coding, returning a reader of the decoded bytes
+type bodyDecoder func(io.Reader) (io.Reader, error)
+
+// bodyDecoders maps Content-Encoding tokens to their decoders. Bodies are only
+// decoded for display; the bytes relayed are always those received.
+var bodyDecoders = map[string]bodyDecoder{
+	"gzip":     decodeGzip,
+	"x-gzip":   decodeGzip,
+	"deflate":  decodeDeflate,
+	"identity": func(r io.Reader) (io.Reader, error) { return r, nil },
+}
+
+// registerBodyDecoder makes bodies with the content coding name displayable, for
+// codings such as br or zstd which need packages of their own
+func registerBodyDecoder(name string, d bodyDecoder) {
+	bodyDecoders[strings.ToLower(name)] = d
+}
+
+func decodeGzip(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// decodeDeflate accepts the zlib format the deflate coding stands for, as well as
+// the raw deflate streams some servers send instead
+func decodeDeflate(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if header, err := br.Peek(2); err == nil && isZlibHeader(header) {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// isZlibHeader reports whether b starts a zlib stream (RFC 1950): the deflate
+// method, with a check value making the first two bytes a multiple of 31
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0F == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+// contentCodings lists the codings of a Content-Encoding header in the order they were applied
+func contentCodings(h http.Header) []string {
+	var codings []string
+	for _, value := range h.Values("Content-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			if coding = strings.ToLower(strings.TrimSpace(coding)); coding != "" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	return codings
+}
+
+// decodeBody returns a reader of body with codings undone, the last applied first
+func decodeBody(body io.Reader, codings []string) (io.Reader, error) {
+	for i := len(codings) - 1; i >= 0; i-- {
+		decode, ok := bodyDecoders[codings[i]]
+		if !ok {
+			return nil, fmt.Errorf("unsupported content encoding %q", codings[i])
+		}
+		var err error
+		if body, err = decode(body); err != nil {
+			return nil, fmt.Errorf("failed to decode %s body: %w", codings[i], err)
+		}
+	}
+	return body, nil
+}
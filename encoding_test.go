@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func zlibbed(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func flated(data []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestContentCodings(t *testing.T) {
+	h := http.Header{}
+	h.Add("Content-Encoding", "GZIP, ,deflate")
+	h.Add("Content-Encoding", " br ")
+	if got, want := strings.Join(contentCodings(h), ","), "gzip,deflate,br"; got != want {
+		t.Errorf("contentCodings = %s, want %s", got, want)
+	}
+	if got := contentCodings(http.Header{}); len(got) != 0 {
+		t.Errorf("contentCodings of no header = %q", got)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	plain := []byte(strings.Repeat("decoded body ", 20))
+	tests := []struct {
+		name    string
+		data    []byte
+		codings []string
+		wantErr string
+	}{
+		{name: "gzip", data: gzipped(plain), codings: []string{"gzip"}},
+		{name: "x-gzip", data: gzipped(plain), codings: []string{"x-gzip"}},
+		{name: "zlib deflate", data: zlibbed(plain), codings: []string{"deflate"}},
+		{name: "raw deflate", data: flated(plain), codings: []string{"deflate"}},
+		{name: "identity", data: plain, codings: []string{"identity"}},
+		{name: "chained", data: gzipped(zlibbed(plain)), codings: []string{"deflate", "gzip"}},
+		{name: "unsupported", data: plain, codings: []string{"br"}, wantErr: `unsupported content encoding "br"`},
+		{name: "unsupported in chain", data: gzipped(plain), codings: []string{"zstd", "gzip"}, wantErr: "unsupported content encoding"},
+		{name: "malformed gzip", data: []byte("not gzip"), codings: []string{"gzip"}, wantErr: "failed to decode gzip body"},
+		{name: "malformed deflate", data: []byte{0xff, 0xff, 0xff}, codings: []string{"deflate"}, wantErr: "corrupt input"},
+		{name: "truncated gzip", data: gzipped(plain)[:20], codings: []string{"gzip"}, wantErr: "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := decodeBody(bytes.NewReader(tt.data), tt.codings)
+			var got []byte
+			if err == nil {
+				got, err = io.ReadAll(r)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("decoded %q, want %q", got, plain)
+			}
+		})
+	}
+}
+
+func TestRegisterBodyDecoder(t *testing.T) {
+	registerBodyDecoder("X-Upper", func(r io.Reader) (io.Reader, error) {
+		data, err := io.ReadAll(r)
+		return bytes.NewReader(bytes.ToUpper(data)), err
+	})
+	defer delete(bodyDecoders, "x-upper")
+
+	r, err := decodeBody(strings.NewReader("shout"), []string{"x-upper"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "SHOUT" {
+		t.Errorf("decoded %q, want SHOUT", got)
+	}
+}
+
+func TestDecodeLimited(t *testing.T) {
+	plain := bytes.Repeat([]byte("a"), 1000)
+	data := gzipped(plain)
+
+	decoded, truncated, err := decodeLimited(data, []string{"gzip"}, 100)
+	if err != nil || !truncated || len(decoded) != 100 {
+		t.Errorf("limit 100: got %d bytes, truncated %v, error %v", len(decoded), truncated, err)
+	}
+	decoded, truncated, err = decodeLimited(data, []string{"gzip"}, 1000)
+	if err != nil || truncated || len(decoded) != 1000 {
+		t.Errorf("limit 1000: got %d bytes, truncated %v, error %v", len(decoded), truncated, err)
+	}
+
+	// What decodes before the body is cut short is still returned
+	decoded, _, err = decodeLimited(data[:len(data)-10], []string{"gzip"}, 2000)
+	if err == nil {
+		t.Error("decoding a truncated body succeeded")
+	}
+	if len(decoded) == 0 {
+		t.Error("nothing was decoded from a truncated body")
+	}
+}
+
+func TestRenderCapturedTruncated(t *testing.T) {
+	h := http.Header{"Content-Encoding": {"gzip"}, "Content-Type": {"text/plain"}}
+	data := gzipped([]byte(strings.Repeat("x", 500)))
+
+	out := renderCaptured(data, int64(len(data)), h, 100)
+	if !strings.Contains(out, "[truncated: printed the first 100 bytes after decoding]") {
+		t.Errorf("decoded body over the limit wasn't marked truncated:\n%s", out)
+	}
+
+	out = renderCaptured([]byte("garbage"), 7, h, 100)
+	if !strings.Contains(out, "failed to decode gzip body") {
+		t.Errorf("undecodable body wasn't noted:\n%s", out)
+	}
+}
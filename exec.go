@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// systemCABundles are the usual locations of the system's trusted roots in PEM form
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian/Ubuntu/Gentoo etc.
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora/RHEL 6
+	"/etc/ssl/ca-bundle.pem",                            // OpenSUSE
+	"/etc/pki/tls/cacert.pem",                           // OpenELEC
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS/RHEL 7
+	"/etc/ssl/cert.pem",                                 // Alpine Linux, macOS
+}
+
+// runExec runs command with its HTTP(S) traffic sent through a private proxy on an
+// ephemeral port, then prints the captured traffic and returns the command's exit code.
+// Neither the system proxy settings, the firewall nor any trust store are modified.
+func runExec(cfg proxyConfig, command []string, noProxy string) int {
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	}
+	if len(command) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: netmiddler [flags] exec -- <command> [args...]")
+		return 2
+	}
+
+	if err := ensureCACertFile(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error handling certificates: %v\n", err)
+		return 1
+	}
+	ca, err := loadCA(caCertFile, caKeyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error handling certificates: %v\n", err)
+		return 1
+	}
+	bundle, err := writeCABundle(caCertFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing CA bundle: %v\n", err)
+		return 1
+	}
+	defer os.Remove(bundle)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start HTTP proxy: %v\n", err)
+		return 1
+	}
+	cfg.port = ln.Addr().(*net.TCPAddr).Port
+	proxy, err := newProxy(ca, cfg)
+	if err != nil {
+		ln.Close()
+		fmt.Fprintf(os.Stderr, "Failed to configure proxy: %v\n", err)
+		return 1
+	}
+
+	// Hold the proxy's log until the command is done, so it doesn't interleave with its output
+	captured := syncBuffer{limit: execLogLimit}
+	log.SetOutput(&captured)
+	server := proxy.newServer()
+	go server.Serve(ln)
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = execEnv(os.Environ(), "http://"+ln.Addr().String(), noProxy, bundle)
+	if err := cmd.Start(); err != nil {
+		server.Close()
+		log.SetOutput(os.Stderr)
+		fmt.Fprintf(os.Stderr, "Failed to start %s: %v\n", command[0], err)
+		return 127
+	}
+
+	// The command decides how to react to signals; we exit once it does. A ^C
+	// typed at the terminal already reaches the command, which shares our
+	// process group, so only signals sent to us alone are passed on.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	go func() {
+		for sig := range sigChan {
+			if !fromTerminal(sig) {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	cmd.Wait()
+	// The command's connections ended with it, so this only waits for their handlers
+	// to record how, before the HAR file is completed and the SAZ archive written
+	proxy.shutdown([]*http.Server{server}, closeGrace)
+	log.SetOutput(os.Stderr)
+	fmt.Fprintf(os.Stderr, "\nCaptured traffic for %s:\n%s", strings.Join(command, " "), captured.String())
+
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return cmd.ProcessState.ExitCode()
+}
+
+// execEnv returns environ with the proxy and CA bundle variables understood by
+// common HTTP clients pointed at the proxy and the combined bundle
+func execEnv(environ []string, proxyURL, noProxy, bundle string) []string {
+	vars := [][2]string{
+		{"HTTP_PROXY", proxyURL},
+		{"HTTPS_PROXY", proxyURL},
+		{"http_proxy", proxyURL},
+		{"https_proxy", proxyURL},
+		{"NO_PROXY", noProxy},
+		{"no_proxy", noProxy},
+		{"SSL_CERT_FILE", bundle},       // OpenSSL, Go, Ruby
+		{"NODE_EXTRA_CA_CERTS", bundle}, // Node.js
+		{"REQUESTS_CA_BUNDLE", bundle},  // Python requests
+		{"CURL_CA_BUNDLE", bundle},      // curl
+		{"GIT_SSL_CAINFO", bundle},      // git
+	}
+
+	env := make([]string, 0, len(environ)+len(vars))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		overridden := false
+		for _, v := range vars {
+			overridden = overridden || v[0] == name
+		}
+		if !overridden {
+			env = append(env, kv)
+		}
+	}
+	for _, v := range vars {
+		env = append(env, v[0]+"="+v[1])
+	}
+	return env
+}
+
+// writeCABundle writes a temporary PEM bundle of the system roots plus the
+// NetMiddler CA, since SSL_CERT_FILE and friends replace rather than extend the roots
+func writeCABundle(caFile string) (string, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return "", err
+	}
+
+	var bundle bytes.Buffer
+	candidates := systemCABundles
+	if f := os.Getenv("SSL_CERT_FILE"); f != "" {
+		candidates = append([]string{f}, candidates...)
+	}
+	for _, f := range candidates {
+		if data, err := os.ReadFile(f); err == nil {
+			bundle.Write(data)
+			if !bytes.HasSuffix(data, []byte("\n")) {
+				bundle.WriteByte('\n')
+			}
+			break
+		}
+	}
+	if bundle.Len() == 0 {
+		fmt.Fprintln(os.Stderr, "No system CA bundle found; only the NetMiddler CA will be trusted")
+	}
+	bundle.Write(caPEM)
+
+	f, err := os.CreateTemp("", "netmiddler-bundle-*.pem")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(bundle.Bytes()); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// execLogLimit caps the proxy log held while the command runs
+const execLogLimit = 16 << 20
+
+// syncBuffer is a bytes.Buffer safe for concurrent use by the logger and readers.
+// Writes beyond limit bytes are only counted.
+type syncBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	limit   int
+	dropped int
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.dropped += len(p) - max(room, 0)
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.dropped > 0 {
+		return fmt.Sprintf("%s\n... %d more bytes of log dropped\n", b.buf.String(), b.dropped)
+	}
+	return b.buf.String()
+}
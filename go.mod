@@ -7,6 +7,7 @@ toolchain go1.21.4
 require (
 	github.com/google/nftables v0.2.0
 	github.com/smallstep/truststore v0.12.1
+	golang.org/x/net v0.22.0
 	golang.org/x/sys v0.18.0
 )
 
@@ -15,7 +16,7 @@ require (
 	github.com/josharian/native v1.1.0 // indirect
 	github.com/mdlayher/netlink v1.7.2 // indirect
 	github.com/mdlayher/socket v0.5.0 // indirect
-	golang.org/x/net v0.22.0 // indirect
 	golang.org/x/sync v0.6.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	howett.net/plist v1.0.0 // indirect
 )
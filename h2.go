@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"slices"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// clientProtos is the ALPN offer made to the client. Clients offering h2 are
+// served h2 whatever the target server speaks, since their requests go through the
+// upstream pool rather than a connection of their own.
+func clientProtos(offered []string) []string {
+	if slices.Contains(offered, "h2") {
+		return []string{"h2", "http/1.1"}
+	}
+	return []string{"http/1.1"}
+}
+
+// serveH2 decodes the client's HTTP/2 streams into individual transactions and
+// forwards each one through the upstream pool. ctx carries the upstreamTarget.
+func (p *Proxy) serveH2(ctx context.Context, client net.Conn, host string) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.forwardH2(w, r, host)
+	})
+	(&http2.Server{IdleTimeout: p.timeouts.idle}).ServeConn(client, &http2.ServeConnOpts{
+		Context:    ctx,
+		Handler:    handler,
+		BaseConfig: &http.Server{},
+	})
+}
+
+// forwardH2 performs one transaction of an HTTP/2 client, including interim
+// responses and trailers
+func (p *Proxy) forwardH2(w http.ResponseWriter, r *http.Request, host string) {
+	// Requests inside the tunnel are origin-form; rebuild the absolute URL
+	r.URL.Scheme = "https"
+	r.URL.Host = r.Host
+	if r.URL.Host == "" {
+		r.URL.Host = host
+	}
+
+	ctx, cancel := withTimeout(r.Context(), p.timeouts.transaction)
+	defer cancel()
+
+	rec := p.sessions.begin(r, "https")
+	var err error
+	defer func() { rec.finish(err) }()
+	ctx = rec.trace(ctx)
+	ctx, progress := traceProgress(ctx)
+
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			return writeInterimHeader(w, code, header)
+		},
+	})
+
+	outReq := r.Clone(ctx)
+	outReq.RequestURI = ""
+	p.prepareRequest(outReq, r, "https")
+
+	rec.captureRequest(outReq)
+	reqLog := teeRequestBody(outReq, "HTTPS Request Body")
+	start := time.Now()
+	resp, err := p.pool.RoundTrip(outReq)
+	reqLog.Close()
+	if err != nil {
+		err = p.timeouts.roundTripError(ctx, progress, err)
+		log.Printf("HTTPS %s %s failed: %v\n", outReq.Method, outReq.URL, err)
+		http.Error(w, err.Error(), upstreamErrorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	logTransaction("HTTPS", outReq, resp, time.Since(start))
+	rec.response(resp)
+
+	// Connection-specific headers from an HTTP/1.1 upstream are invalid in HTTP/2
+	p.prepareResponse(resp)
+	for key, value := range resp.Header {
+		w.Header()[key] = value
+	}
+	for key := range resp.Trailer {
+		w.Header().Add("Trailer", key)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var bodyReader io.Reader = resp.Body
+	if printBody {
+		bodyLog := bodyLogWriter("HTTPS Response Body", resp.Header)
+		defer bodyLog.Close()
+		bodyReader = io.TeeReader(resp.Body, bodyLog)
+	}
+	if _, err = io.Copy(flushWriter{w}, bodyReader); err != nil {
+		err = p.timeouts.bodyError(ctx, err)
+		log.Printf("HTTPS %s %s failed: %v\n", outReq.Method, outReq.URL, err)
+		return
+	}
+
+	// Trailers are only known once the body has been read
+	for key, value := range resp.Trailer {
+		w.Header()[key] = value
+	}
+}
+
+// flushWriter flushes after every write so streamed responses aren't held back
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestClientProtos(t *testing.T) {
+	tests := []struct {
+		offered []string
+		want    []string
+	}{
+		{[]string{"h2", "http/1.1"}, []string{"h2", "http/1.1"}},
+		{[]string{"h2"}, []string{"h2", "http/1.1"}},
+		{[]string{"http/1.1"}, []string{"http/1.1"}},
+		{nil, []string{"http/1.1"}},
+	}
+	for _, tt := range tests {
+		if got := clientProtos(tt.offered); !slices.Equal(got, tt.want) {
+			t.Errorf("clientProtos(%q) = %q, want %q", tt.offered, got, tt.want)
+		}
+	}
+}
+
+// TestLegNegotiation checks each leg of an intercepted tunnel negotiates its own
+// protocol: the client is served h2 if it offers it, and the target server is
+// spoken to in h2 if it supports it, in every combination
+func TestLegNegotiation(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientProtos []string
+		upstreamH2   bool
+		wantClient   string
+		wantUpstream string
+	}{
+		{"h2 to h2", []string{"h2", "http/1.1"}, true, "h2", "HTTP/2.0"},
+		{"h2 to HTTP/1.1", []string{"h2", "http/1.1"}, false, "h2", "HTTP/1.1"},
+		{"HTTP/1.1 to h2", []string{"http/1.1"}, true, "http/1.1", "HTTP/2.0"},
+		{"HTTP/1.1 to HTTP/1.1", []string{"http/1.1"}, false, "http/1.1", "HTTP/1.1"},
+		{"no ALPN", nil, true, "", "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, r.Proto)
+			}))
+			upstream.EnableHTTP2 = tt.upstreamH2
+			upstream.StartTLS()
+			defer upstream.Close()
+			p, proxyAddr := startTestProxy(t, upstream)
+
+			conn := interceptTunnel(t, p, proxyAddr, upstream, tt.clientProtos...)
+			if got := conn.ConnectionState().NegotiatedProtocol; got != tt.wantClient {
+				t.Fatalf("client leg negotiated %q, want %q", got, tt.wantClient)
+			}
+
+			req, _ := http.NewRequest("GET", "https://"+upstream.Listener.Addr().String()+"/", nil)
+			var resp *http.Response
+			var err error
+			if tt.wantClient == "h2" {
+				cc, ccErr := (&http2.Transport{}).NewClientConn(conn)
+				if ccErr != nil {
+					t.Fatal(ccErr)
+				}
+				resp, err = cc.RoundTrip(req)
+			} else {
+				if err = req.Write(conn); err == nil {
+					resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.wantUpstream {
+				t.Errorf("target server saw %s, want %s", body, tt.wantUpstream)
+			}
+			if tt.wantClient == "h2" && resp.ProtoMajor != 2 {
+				t.Errorf("client got an %s response", resp.Proto)
+			}
+		})
+	}
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/). Fields NetMiddler
+// records beyond the spec are prefixed with an underscore, as the spec requires;
+// WebSocket messages use the _webSocketMessages field of browser exports.
+
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+
+	ClientAddr        string         `json:"_clientAddr,omitempty"`
+	ConnectHost       string         `json:"_connectHost,omitempty"`
+	TLS               *SessionTLS    `json:"_tls,omitempty"`
+	Error             string         `json:"_error,omitempty"`
+	TimeoutPhase      string         `json:"_timeoutPhase,omitempty"`
+	WebSocketMessages []harWebSocket `json:"_webSocketMessages,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	Trailers    []harNameValue `json:"_trailers,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	Trailers    []harNameValue `json:"_trailers,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+// harPostData has no encoding in HAR 1.2, so binary request bodies are marked
+// with _encoding like response content
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []harNameValue `json:"params,omitempty"`
+	Text     string         `json:"text"`
+	Encoding string         `json:"_encoding,omitempty"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// harTimings are in milliseconds; -1 marks a phase which doesn't apply or wasn't
+// measured. DNS and connecting are part of blocked, since the upstream pool dials
+// on the request's behalf.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+type harWebSocket struct {
+	Type   string  `json:"type"`
+	Time   float64 `json:"time"` // seconds since the Unix epoch
+	Opcode byte    `json:"opcode"`
+	Data   string  `json:"data"`
+}
+
+// harVersion is the version of the HAR format written
+const harVersion = "1.2"
+
+// maxHARDecodedBody caps a body once decoded, as a small compressed body may
+// expand enormously
+const maxHARDecodedBody = 64 << 20
+
+// harCreatorInfo names NetMiddler, with its module version when built from one
+func harCreatorInfo() harCreator {
+	creator := harCreator{Name: "NetMiddler", Version: "devel"}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		creator.Version = info.Main.Version
+	}
+	return creator
+}
+
+// harHeader and harFooter enclose the entries of a HAR log, which are written
+// between them one at a time
+func harHeader() string {
+	creator, _ := json.Marshal(harCreatorInfo())
+	return fmt.Sprintf(`{"log":{"version":%q,"creator":%s,"entries":[`, harVersion, creator)
+}
+
+const harFooter = "\n]}}\n"
+
+// writeHAR streams sessions to w as a HAR log
+func writeHAR(w io.Writer, sessions []Session) error {
+	if _, err := io.WriteString(w, harHeader()); err != nil {
+		return err
+	}
+	for i, s := range sessions {
+		entry, err := json.Marshal(sessionToHAR(s))
+		if err != nil {
+			return err
+		}
+		sep := ",\n"
+		if i == 0 {
+			sep = "\n"
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		if _, err := w.Write(entry); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, harFooter)
+	return err
+}
+
+// harFile appends sessions to a HAR file as they finish, from a goroutine of its
+// own. The footer is rewritten after each entry, so the file is a complete HAR
+// log whenever the proxy stops.
+type harFile struct {
+	f       *os.File
+	entries int // only used by the writer goroutine
+
+	mu      sync.Mutex
+	pending []Session // finished sessions the writer hasn't taken yet
+	closed  bool
+	wake    chan struct{} // signalled when sessions are pending or the file is closed
+	done    chan struct{}
+}
+
+// createHARFile creates the HAR file at path, replacing any file there, and
+// starts writing the sessions queued for it
+func createHARFile(path string) (*harFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HAR file: %w", err)
+	}
+	if _, err := io.WriteString(f, harHeader()+harFooter); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write HAR file: %w", err)
+	}
+	h := &harFile{f: f, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go h.run()
+	return h, nil
+}
+
+// enqueue queues s to be written without waiting, as session observers must not
+// block. The queue is unbounded, so no session is left out when the file is slow.
+func (h *harFile) enqueue(s Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.pending = append(h.pending, s)
+	h.signal()
+}
+
+// signal wakes the writer, unless it already has a wakeup waiting
+func (h *harFile) signal() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run writes the pending sessions as they are queued, until the file is closed
+// and nothing is left
+func (h *harFile) run() {
+	defer close(h.done)
+	for {
+		h.mu.Lock()
+		batch, closed := h.pending, h.closed
+		h.pending = nil
+		h.mu.Unlock()
+
+		if len(batch) == 0 {
+			if closed {
+				return
+			}
+			<-h.wake
+			continue
+		}
+		for _, s := range batch {
+			if err := h.add(s); err != nil {
+				log.Printf("Failed to write session %d to HAR file: %v\n", s.ID, err)
+			}
+		}
+	}
+}
+
+// add appends s, overwriting the footer and writing it again after the entry
+func (h *harFile) add(s Session) error {
+	entry, err := json.Marshal(sessionToHAR(s))
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if h.entries == 0 {
+		sep = "\n"
+	}
+	if _, err := h.f.Seek(-int64(len(harFooter)), io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := h.f.Write([]byte(sep + string(entry) + harFooter)); err != nil {
+		return err
+	}
+	h.entries++
+	return nil
+}
+
+// Close writes the sessions still queued, then closes the file
+func (h *harFile) Close() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	h.signal()
+	h.mu.Unlock()
+
+	<-h.done
+	return h.f.Close()
+}
+
+// sessionToHAR maps a session to a HAR entry. Bodies are decoded from their
+// Content-Encoding as HAR expects, and base64 encoded unless they are text.
+func sessionToHAR(s Session) harEntry {
+	e := harEntry{
+		StartedDateTime: s.Timings.Start,
+		ClientAddr:      s.ClientAddr,
+		ConnectHost:     s.ConnectHost,
+		TLS:             s.TLS,
+		Error:           s.Error,
+		TimeoutPhase:    s.TimeoutPhase,
+	}
+
+	e.Request = harRequest{
+		Method:      s.Method,
+		URL:         s.URL,
+		HTTPVersion: s.RequestProto,
+		Cookies:     harCookies((&http.Request{Header: s.RequestHeader}).Cookies()),
+		Headers:     harHeaders(s.RequestHeader),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    s.RequestBody.Size,
+		Trailers:    harHeaders(s.RequestTrailer),
+	}
+	if u, err := url.Parse(s.URL); err == nil {
+		e.Request.QueryString = harQuery(u.RawQuery)
+	}
+	if s.RequestBody.Size > 0 {
+		e.Request.PostData = harRequestBody(s.RequestHeader, s.RequestBody)
+	}
+
+	e.Response = harResponse{
+		Status:      s.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(s.Status, fmt.Sprint(s.StatusCode))),
+		HTTPVersion: s.ResponseProto,
+		Cookies:     harCookies((&http.Response{Header: s.ResponseHeader}).Cookies()),
+		Headers:     harHeaders(s.ResponseHeader),
+		Content:     harResponseBody(s.ResponseHeader, s.ResponseBody),
+		RedirectURL: s.ResponseHeader.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    s.ResponseBody.Size,
+		Trailers:    harHeaders(s.ResponseTrailer),
+	}
+	if s.StatusCode == 0 {
+		// HAR has no entries without responses; failed transactions get status 0, as in browsers
+		e.Response.BodySize = -1
+	}
+
+	e.Timings, e.Time = harTimingsOf(s.Timings)
+
+	for _, msg := range s.WebSocket {
+		data := string(msg.Payload)
+		if msg.Opcode != wsText {
+			data = base64.StdEncoding.EncodeToString(msg.Payload)
+		}
+		e.WebSocketMessages = append(e.WebSocketMessages, harWebSocket{
+			Type:   msg.Direction,
+			Time:   float64(msg.Time.UnixMicro()) / 1e6,
+			Opcode: msg.Opcode,
+			Data:   data,
+		})
+	}
+	return e
+}
+
+// harTimingsOf splits the moments a transaction reached into HAR phases, and
+// returns their total
+func harTimingsOf(t SessionTimings) (harTimings, float64) {
+	ms := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() || to.Before(from) {
+			return 0
+		}
+		return float64(to.Sub(from).Microseconds()) / 1000
+	}
+	timings := harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+	if !t.GotConn.IsZero() {
+		timings.Blocked = ms(t.Start, t.GotConn)
+		timings.Send = ms(t.GotConn, t.RequestSent)
+	}
+	// The request may still be going out when the response starts
+	waitFrom := t.RequestSent
+	if waitFrom.IsZero() || (!t.FirstByte.IsZero() && t.FirstByte.Before(waitFrom)) {
+		waitFrom = t.GotConn
+	}
+	timings.Wait = ms(waitFrom, t.FirstByte)
+	timings.Receive = ms(t.FirstByte, t.End)
+	return timings, ms(t.Start, t.End)
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	list := []harNameValue{}
+	for _, key := range sortedKeys(h) {
+		for _, value := range h[key] {
+			list = append(list, harNameValue{Name: key, Value: value})
+		}
+	}
+	return list
+}
+
+// sortedKeys returns the keys of h in order, so exports are deterministic
+func sortedKeys(h http.Header) []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func harQuery(rawQuery string) []harNameValue {
+	list := []harNameValue{}
+	for _, field := range strings.Split(rawQuery, "&") {
+		if field == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(field, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+		list = append(list, harNameValue{Name: name, Value: value})
+	}
+	return list
+}
+
+func harCookies(cookies []*http.Cookie) []harCookie {
+	list := []harCookie{}
+	for _, c := range cookies {
+		hc := harCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			expires := c.Expires
+			hc.Expires = &expires
+		}
+		list = append(list, hc)
+	}
+	return list
+}
+
+// harBody decodes body according to the Content-Encoding in h, returning the
+// text or base64 encoded bytes to store, the encoding used and any comment on
+// what was left out. Bodies which can't be decoded are kept as relayed.
+func harBody(h http.Header, body SessionBody) (data []byte, text, encoding string, comments []string) {
+	data = body.Data
+	if codings := contentCodings(h); len(codings) > 0 {
+		decoded, truncated, err := decodeLimited(body.Data, codings, maxHARDecodedBody)
+		// A body cut short can only be decoded up to the cut
+		if err == nil || body.Truncated() && len(decoded) > 0 {
+			data = decoded
+		} else {
+			comments = append(comments, fmt.Sprintf("not decoded: %v", err))
+		}
+		if truncated {
+			comments = append(comments, fmt.Sprintf("truncated: kept the first %d bytes after decoding", maxHARDecodedBody))
+		}
+	}
+	if body.Truncated() {
+		comments = append(comments, fmt.Sprintf("truncated: captured the first %d of %d bytes", len(body.Data), body.Size))
+	}
+	if utf8.Valid(data) && isPrintable(data) {
+		return data, string(data), "", comments
+	}
+	return data, base64.StdEncoding.EncodeToString(data), "base64", comments
+}
+
+func harRequestBody(h http.Header, body SessionBody) *harPostData {
+	_, text, encoding, comments := harBody(h, body)
+	post := &harPostData{
+		MimeType: h.Get("Content-Type"),
+		Text:     text,
+		Encoding: encoding,
+		Comment:  strings.Join(comments, "; "),
+	}
+	if mediaType, _, _ := mime.ParseMediaType(post.MimeType); mediaType == "application/x-www-form-urlencoded" && encoding == "" {
+		post.Params = harQuery(text)
+	}
+	return post
+}
+
+func harResponseBody(h http.Header, body SessionBody) harContent {
+	data, text, encoding, comments := harBody(h, body)
+	content := harContent{
+		Size:     int64(len(data)),
+		MimeType: h.Get("Content-Type"),
+		Text:     text,
+		Encoding: encoding,
+		Comment:  strings.Join(comments, "; "),
+	}
+	if !body.Truncated() && content.Size > body.Size {
+		content.Compression = content.Size - body.Size
+	}
+	if content.MimeType == "" {
+		content.MimeType = "x-unknown"
+	}
+	return content
+}
+
+// readHAR reads the entries of a HAR log as sessions. Bodies in HAR are decoded,
+// so the Content-Encoding of a body which doesn't decode again is dropped.
+func readHAR(r io.Reader) ([]*Session, error) {
+	var doc harLog
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid HAR: %w", err)
+	}
+	sessions := make([]*Session, 0, len(doc.Log.Entries))
+	for i, e := range doc.Log.Entries {
+		s, err := harToSession(e)
+		if err != nil {
+			return nil, fmt.Errorf("HAR entry %d: %w", i, err)
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+func harToSession(e harEntry) (*Session, error) {
+	s := &Session{
+		ClientAddr:      e.ClientAddr,
+		ConnectHost:     e.ConnectHost,
+		Method:          e.Request.Method,
+		URL:             e.Request.URL,
+		RequestProto:    e.Request.HTTPVersion,
+		RequestHeader:   headersFromHAR(e.Request.Headers),
+		RequestTrailer:  headersFromHAR(e.Request.Trailers),
+		StatusCode:      e.Response.Status,
+		ResponseProto:   e.Response.HTTPVersion,
+		ResponseHeader:  headersFromHAR(e.Response.Headers),
+		ResponseTrailer: headersFromHAR(e.Response.Trailers),
+		TLS:             e.TLS,
+		Error:           e.Error,
+		TimeoutPhase:    e.TimeoutPhase,
+		Done:            true,
+	}
+	if u, err := url.Parse(s.URL); err == nil {
+		s.Scheme = u.Scheme
+	}
+	if s.StatusCode != 0 {
+		s.Status = fmt.Sprintf("%d %s", s.StatusCode, e.Response.StatusText)
+	}
+
+	if e.Request.PostData != nil {
+		data, err := harDecodeText(e.Request.PostData.Text, e.Request.PostData.Encoding)
+		if err != nil {
+			return nil, fmt.Errorf("request body: %w", err)
+		}
+		s.RequestBody = importedBody(s.RequestHeader, data, e.Request.BodySize)
+	}
+	data, err := harDecodeText(e.Response.Content.Text, e.Response.Content.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("response body: %w", err)
+	}
+	s.ResponseBody = importedBody(s.ResponseHeader, data, e.Response.BodySize)
+
+	s.Timings = timingsFromHAR(e.StartedDateTime, e.Time, e.Timings)
+
+	for _, m := range e.WebSocketMessages {
+		payload := []byte(m.Data)
+		if m.Opcode != wsText {
+			if payload, err = base64.StdEncoding.DecodeString(m.Data); err != nil {
+				return nil, fmt.Errorf("WebSocket message: %w", err)
+			}
+		}
+		sec := int64(m.Time)
+		s.WebSocket = append(s.WebSocket, &WebSocketMessage{
+			Direction: m.Type,
+			Opcode:    m.Opcode,
+			Time:      time.Unix(sec, int64((m.Time-float64(sec))*1e9)),
+			Payload:   payload,
+		})
+	}
+	return s, nil
+}
+
+func headersFromHAR(list []harNameValue) http.Header {
+	if len(list) == 0 {
+		return nil
+	}
+	h := make(http.Header)
+	for _, nv := range list {
+		h.Add(nv.Name, nv.Value)
+	}
+	return h
+}
+
+func harDecodeText(text, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(text), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// importedBody makes a session body of data, the decoded body from a HAR. If
+// the headers claim a coding the data no longer has, the claim is dropped.
+func importedBody(h http.Header, data []byte, size int64) SessionBody {
+	if codings := contentCodings(h); len(codings) > 0 {
+		if r, err := decodeBody(bytes.NewReader(data), codings); err != nil {
+			h.Del("Content-Encoding")
+		} else if _, err := io.Copy(io.Discard, r); err != nil {
+			h.Del("Content-Encoding")
+		}
+	}
+	if size < int64(len(data)) || h.Get("Content-Encoding") == "" {
+		size = int64(len(data))
+	}
+	return SessionBody{Data: data, Size: size}
+}
+
+// timingsFromHAR rebuilds the moments of a transaction from its HAR phases
+func timingsFromHAR(start time.Time, total float64, t harTimings) SessionTimings {
+	at := func(ms float64) time.Time {
+		return start.Add(time.Duration(ms * float64(time.Millisecond)))
+	}
+	pos := func(ms float64) float64 { return max(ms, 0) }
+	timings := SessionTimings{Start: start, End: at(total)}
+	// A transaction which failed before reaching the server has no phases
+	if t.Blocked < 0 && t.Send <= 0 && t.Wait <= 0 && t.Receive <= 0 {
+		return timings
+	}
+	gotConn := pos(t.Blocked) + pos(t.DNS) + pos(t.Connect)
+	timings.GotConn = at(gotConn)
+	timings.RequestSent = at(gotConn + pos(t.Send))
+	timings.FirstByte = at(gotConn + pos(t.Send) + pos(t.Wait))
+	return timings
+}
+
+// setupHAR loads the sessions of the HAR file importPath, then has sessions written
+// to the HAR file exportPath as they finish. Either path may be empty.
+func (p *Proxy) setupHAR(importPath, exportPath string) error {
+	if p.sessions == nil {
+		if importPath != "" || exportPath != "" {
+			return errors.New("-har and -import-har need sessions to be kept; set -max-sessions")
+		}
+		return nil
+	}
+	if importPath != "" {
+		n, err := p.sessions.loadHAR(importPath)
+		if err != nil {
+			return fmt.Errorf("failed to import HAR file %s: %w", importPath, err)
+		}
+		log.Printf("Imported %d sessions from %s\n", n, importPath)
+	}
+	if exportPath == "" {
+		return nil
+	}
+	har, err := createHARFile(exportPath)
+	if err != nil {
+		return err
+	}
+	p.har = har
+	p.sessions.observe(func(s Session) {
+		if s.Done {
+			har.enqueue(s)
+		}
+	})
+	return nil
+}
+
+// loadHAR adds the sessions of the HAR file at path to the store
+func (st *sessionStore) loadHAR(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sessions, err := readHAR(f)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range sessions {
+		st.add(s)
+	}
+	return len(sessions), nil
+}
+
+// serveHAR serves the sessions held as a HAR download
+func (st *sessionStore) serveHAR(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="netmiddler.har"`)
+	if err := writeHAR(w, st.finished()); err != nil {
+		log.Printf("Failed to serve HAR export: %v\n", err)
+	}
+}
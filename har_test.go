@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSessions returns finished sessions covering what captures must carry: a
+// request body, a compressed response, a binary body, WebSocket messages and a failure
+func testSessions() []Session {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	timings := SessionTimings{
+		Start:       start,
+		GotConn:     start.Add(10 * time.Millisecond),
+		RequestSent: start.Add(15 * time.Millisecond),
+		FirstByte:   start.Add(40 * time.Millisecond),
+		End:         start.Add(50 * time.Millisecond),
+	}
+	page := []byte("<html>compressed page</html>")
+	return []Session{
+		{
+			ID:             1,
+			ClientAddr:     "127.0.0.1:50000",
+			ConnectHost:    "example.com:443",
+			Scheme:         "https",
+			Method:         "POST",
+			URL:            "https://example.com/form?q=1",
+			RequestProto:   "HTTP/1.1",
+			RequestHeader:  http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+			RequestBody:    SessionBody{Data: []byte("a=1&b=2"), Size: 7},
+			StatusCode:     200,
+			Status:         "200 OK",
+			ResponseProto:  "HTTP/1.1",
+			ResponseHeader: http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}},
+			ResponseBody:   SessionBody{Data: gzipped(page), Size: int64(len(gzipped(page)))},
+			Timings:        timings,
+			Done:           true,
+		},
+		{
+			ID:             2,
+			ClientAddr:     "127.0.0.1:50001",
+			Scheme:         "http",
+			Method:         "GET",
+			URL:            "http://example.com/logo.png",
+			RequestProto:   "HTTP/1.1",
+			RequestHeader:  http.Header{"Accept": {"image/png"}},
+			StatusCode:     200,
+			Status:         "200 OK",
+			ResponseProto:  "HTTP/1.1",
+			ResponseHeader: http.Header{"Content-Type": {"image/png"}},
+			ResponseBody:   SessionBody{Data: []byte{0x89, 'P', 'N', 'G', 0, 0xff}, Size: 6},
+			Timings:        timings,
+			Done:           true,
+		},
+		{
+			ID:             3,
+			ClientAddr:     "127.0.0.1:50002",
+			Scheme:         "http",
+			Method:         "GET",
+			URL:            "http://example.com/ws",
+			RequestProto:   "HTTP/1.1",
+			RequestHeader:  http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}},
+			StatusCode:     101,
+			Status:         "101 Switching Protocols",
+			ResponseProto:  "HTTP/1.1",
+			ResponseHeader: http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}},
+			Timings:        timings,
+			WebSocket: []*WebSocketMessage{
+				{Direction: wsSend, Opcode: wsText, Time: start.Add(time.Second), Payload: []byte("hello")},
+				{Direction: wsReceive, Opcode: wsBinary, Time: start.Add(2 * time.Second), Payload: []byte{0, 1, 2, 0xff}},
+			},
+			Done: true,
+		},
+		{
+			ID:            4,
+			ClientAddr:    "127.0.0.1:50003",
+			Scheme:        "http",
+			Method:        "GET",
+			URL:           "http://slow.example/",
+			RequestProto:  "HTTP/1.1",
+			RequestHeader: http.Header{"Accept": {"*/*"}},
+			Timings:       SessionTimings{Start: start, End: start.Add(time.Second)},
+			Error:         "upstream response header timed out after 1s",
+			TimeoutPhase:  phaseResponseHeader,
+			Done:          true,
+		},
+	}
+}
+
+// checkImported compares the sessions read back from a capture with those written
+func checkImported(t *testing.T, got []*Session, want []Session) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("read %d sessions, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Method != w.Method || g.URL != w.URL || g.Scheme != w.Scheme || g.StatusCode != w.StatusCode {
+			t.Errorf("session %d: got %s %s (%s) %d, want %s %s (%s) %d", i, g.Method, g.URL, g.Scheme, g.StatusCode, w.Method, w.URL, w.Scheme, w.StatusCode)
+		}
+		if g.Error != w.Error || g.TimeoutPhase != w.TimeoutPhase {
+			t.Errorf("session %d: got error %q (%s), want %q (%s)", i, g.Error, g.TimeoutPhase, w.Error, w.TimeoutPhase)
+		}
+		if !bytes.Equal(g.RequestBody.Data, w.RequestBody.Data) {
+			t.Errorf("session %d: got request body %q, want %q", i, g.RequestBody.Data, w.RequestBody.Data)
+		}
+		for key := range w.RequestHeader {
+			if g.RequestHeader.Get(key) != w.RequestHeader.Get(key) {
+				t.Errorf("session %d: got request header %s %q, want %q", i, key, g.RequestHeader.Get(key), w.RequestHeader.Get(key))
+			}
+		}
+		if !g.Timings.Start.Equal(w.Timings.Start) {
+			t.Errorf("session %d: started at %v, want %v", i, g.Timings.Start, w.Timings.Start)
+		}
+		if len(g.WebSocket) != len(w.WebSocket) {
+			t.Errorf("session %d: got %d WebSocket messages, want %d", i, len(g.WebSocket), len(w.WebSocket))
+			continue
+		}
+		for j, wm := range w.WebSocket {
+			gm := g.WebSocket[j]
+			if gm.Direction != wm.Direction || gm.Opcode != wm.Opcode || !bytes.Equal(gm.Payload, wm.Payload) {
+				t.Errorf("session %d message %d: got %s %d %q, want %s %d %q", i, j, gm.Direction, gm.Opcode, gm.Payload, wm.Direction, wm.Opcode, wm.Payload)
+			}
+		}
+	}
+}
+
+// decodedResponse returns the response body of s with its content codings undone
+func decodedResponse(t *testing.T, s *Session) []byte {
+	t.Helper()
+	codings := contentCodings(s.ResponseHeader)
+	if len(codings) == 0 {
+		return s.ResponseBody.Data
+	}
+	data, _, err := decodeLimited(s.ResponseBody.Data, codings, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestHARRoundTrip(t *testing.T) {
+	sessions := testSessions()
+	var buf bytes.Buffer
+	if err := writeHAR(&buf, sessions); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readHAR(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImported(t, got, sessions)
+
+	// HAR bodies are decoded, so the coding is dropped on import
+	if got[0].ResponseHeader.Get("Content-Encoding") != "" {
+		t.Error("Content-Encoding kept for a decoded body")
+	}
+	if body := string(decodedResponse(t, got[0])); body != "<html>compressed page</html>" {
+		t.Errorf("got response body %q", body)
+	}
+	if !bytes.Equal(got[1].ResponseBody.Data, sessions[1].ResponseBody.Data) {
+		t.Errorf("binary body came back as % x", got[1].ResponseBody.Data)
+	}
+}
+
+func TestHARFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+	har, err := createHARFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := testSessions()
+	for _, s := range sessions {
+		har.enqueue(s)
+	}
+	if err := har.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Sessions finishing after the file is closed are ignored
+	har.enqueue(sessions[0])
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := readHAR(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImported(t, got, sessions)
+}
+
+func TestReadHARMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{"not JSON", "not a HAR", "invalid HAR"},
+		{"truncated", harHeader() + `{"request":`, "invalid HAR"},
+		{"bad body encoding", `{"log":{"entries":[{"request":{"method":"GET","url":"http://a/"},"response":{"content":{"text":"x","encoding":"gzip"}}}]}}`, `unsupported encoding "gzip"`},
+		{"bad base64", `{"log":{"entries":[{"request":{"method":"GET","url":"http://a/"},"response":{"content":{"text":"!!","encoding":"base64"}}}]}}`, "response body"},
+		{"bad request body", `{"log":{"entries":[{"request":{"method":"POST","url":"http://a/","postData":{"text":"!!","_encoding":"base64"}},"response":{"content":{}}}]}}`, "request body"},
+		{"bad WebSocket message", `{"log":{"entries":[{"request":{"method":"GET","url":"http://a/"},"response":{"content":{}},"_webSocketMessages":[{"type":"send","opcode":2,"data":"!!"}]}]}}`, "WebSocket message"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readHAR(strings.NewReader(tt.input))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestHARFileUnderLoad queues sessions far faster than they are written; every
+// one of them must reach the file
+func TestHARFileUnderLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+	har, err := createHARFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 2000
+	s := testSessions()[1]
+	for i := 0; i < n; i++ {
+		s.ID = uint64(i + 1)
+		har.enqueue(s)
+	}
+	if err := har.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := readHAR(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != n {
+		t.Errorf("HAR file holds %d sessions, want %d", len(got), n)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// viaPseudonym identifies the proxy in Via headers
+const viaPseudonym = "netmiddler"
+
+// hopHeaders apply to a single connection (RFC 9110 section 7.6.1), so a proxy
+// never forwards them. Proxy-Connection and Keep-Alive are obsolete but still sent.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardingHeaders selects the headers added to forwarded requests to reveal the
+// proxy and the client, as configured with -forwarding-headers
+type forwardingHeaders struct {
+	via           bool
+	xForwardedFor bool
+	forwarded     bool
+}
+
+// parseForwardingHeaders parses the comma separated -forwarding-headers flag
+func parseForwardingHeaders(s string) (forwardingHeaders, error) {
+	var f forwardingHeaders
+	for _, name := range strings.Split(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+		case "via":
+			f.via = true
+		case "x-forwarded-for":
+			f.xForwardedFor = true
+		case "forwarded":
+			f.forwarded = true
+		default:
+			return f, fmt.Errorf("unknown forwarding header %q in -forwarding-headers", name)
+		}
+	}
+	return f, nil
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including any named in
+// its Connection header
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// hasToken reports whether a comma separated header of h lists token, ignoring
+// case and any parameters
+func hasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			t, _, _ = strings.Cut(t, ";")
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prepareRequest readies out, a copy of the request in received from a client over
+// scheme, for forwarding. Hop-by-hop headers are removed, except for those asking
+// to switch protocols and "TE: trailers", and the configured forwarding headers are added.
+func (p *Proxy) prepareRequest(out, in *http.Request, scheme string) {
+	upgrade := ""
+	if isUpgradeRequest(in) {
+		upgrade = in.Header.Get("Upgrade")
+	}
+	out.Header = in.Header.Clone()
+	removeHopHeaders(out.Header)
+	if upgrade != "" {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", upgrade)
+	}
+	// Servers such as gRPC's won't send trailers without it; httputil.ReverseProxy keeps it too
+	if hasToken(in.Header, "TE", "trailers") {
+		out.Header.Set("TE", "trailers")
+	}
+	// The transport manages its own connections
+	out.Close = false
+
+	if p.forwarding.via {
+		out.Header.Add("Via", viaEntry(in.ProtoMajor, in.ProtoMinor))
+	}
+	clientIP, _, err := net.SplitHostPort(in.RemoteAddr)
+	if err != nil {
+		return
+	}
+	if p.forwarding.xForwardedFor {
+		chain := clientIP
+		if prior := out.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			chain = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		out.Header.Set("X-Forwarded-For", chain)
+	}
+	if p.forwarding.forwarded {
+		// IPv6 addresses are quoted, since they contain colons (RFC 7239 section 6)
+		node := clientIP
+		if strings.Contains(node, ":") {
+			node = `"[` + node + `]"`
+		}
+		out.Header.Add("Forwarded", fmt.Sprintf("for=%s;host=%q;proto=%s", node, in.Host, scheme))
+	}
+}
+
+// prepareResponse removes the hop-by-hop headers from the headers of resp before
+// they are relayed to the client, unless it switches protocols, and adds Via when configured
+func (p *Proxy) prepareResponse(resp *http.Response) {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		removeHopHeaders(resp.Header)
+	}
+	if p.forwarding.via {
+		resp.Header.Add("Via", viaEntry(resp.ProtoMajor, resp.ProtoMinor))
+	}
+}
+
+// viaEntry is the Via header value for a message received over HTTP/major.minor
+func viaEntry(major, minor int) string {
+	if major >= 2 {
+		return fmt.Sprintf("%d %s", major, viaPseudonym)
+	}
+	return fmt.Sprintf("%d.%d %s", major, minor, viaPseudonym)
+}
+
+// writeInterimHeader relays a 1xx response to a client served by an http.Server.
+// Interim responses take their headers from the ResponseWriter, so they are
+// cleared again for the final response.
+func writeInterimHeader(w http.ResponseWriter, code int, header textproto.MIMEHeader) error {
+	for key, value := range header {
+		w.Header()[key] = value
+	}
+	w.WriteHeader(code)
+	for key := range header {
+		w.Header().Del(key)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrepareRequestTE(t *testing.T) {
+	tests := []struct {
+		te   []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"trailers"}, "trailers"},
+		{[]string{"gzip;q=0.5, Trailers"}, "trailers"},
+		{[]string{"deflate", "trailers;q=1"}, "trailers"},
+		{[]string{"gzip, deflate"}, ""},
+		{[]string{"trailersx"}, ""},
+	}
+	p := &Proxy{}
+	for _, tt := range tests {
+		in := httptest.NewRequest("GET", "http://example.com/", nil)
+		in.Header["Te"] = tt.te
+		in.Header.Set("Connection", "TE")
+		out := in.Clone(in.Context())
+		p.prepareRequest(out, in, "http")
+		if got := strings.Join(out.Header.Values("TE"), ","); got != tt.want {
+			t.Errorf("TE %q was forwarded as %q, want %q", tt.te, got, tt.want)
+		}
+		if out.Header.Get("Connection") != "" {
+			t.Errorf("Connection header was forwarded")
+		}
+	}
+}
+
+func TestHasToken(t *testing.T) {
+	h := http.Header{"Connection": {"keep-alive, Upgrade", "close"}}
+	for token, want := range map[string]bool{"upgrade": true, "close": true, "keep-alive": true, "up": false} {
+		if got := hasToken(h, "Connection", token); got != want {
+			t.Errorf("hasToken(%q) = %v, want %v", token, got, want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// hostList matches hosts against a list of patterns. A pattern is an exact name,
+// "*.example.com", which matches example.com and any subdomain, "*", which matches
+// everything, or an IP address or CIDR range such as 10.0.0.0/8, which match hosts
+// given as IP addresses.
+type hostList []string
+
+// parseHostList parses a comma separated list of host patterns
+func parseHostList(s string) hostList {
+	var list hostList
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			// Normalize addresses so they compare equal however they were written
+			if ip := net.ParseIP(strings.Trim(pattern, "[]")); ip != nil {
+				pattern = ip.String()
+			}
+			list = append(list, pattern)
+		}
+	}
+	return list
+}
+
+// Match reports whether host, which may carry a port, matches any pattern
+func (l hostList) Match(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(hostOnly(host)), ".")
+	ip := net.ParseIP(host)
+	if ip != nil {
+		host = ip.String()
+	}
+	for _, pattern := range l {
+		if pattern == "*" {
+			return true
+		} else if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if _, cidr, err := net.ParseCIDR(pattern); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchAddr reports whether either the host name or the IP address it resolved to
+// matches, so CIDR patterns also apply to hosts reached by name
+func (l hostList) MatchAddr(host string, ip net.IP) bool {
+	return l.Match(host) || (ip != nil && l.Match(ip.String()))
+}
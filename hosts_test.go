@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHostListMatch(t *testing.T) {
+	list := parseHostList(" Example.com, *.internal.test ,10.0.0.0/8, [2001:DB8::1], 192.168.1.1,, ")
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.COM:443", true},
+		{"example.com.", true},
+		{"www.example.com", false},
+		{"notexample.com", false},
+		{"internal.test", true},
+		{"a.b.internal.test:8443", true},
+		{"xinternal.test", false},
+		{"10.1.2.3", true},
+		{"10.1.2.3:443", true},
+		{"11.0.0.1", false},
+		{"[2001:db8:0::1]:443", true},
+		{"2001:db8::2", false},
+		{"192.168.1.1", true},
+		{"192.168.1.10", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := list.Match(tt.host); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	if !parseHostList("*").Match("anything.example") {
+		t.Error(`"*" doesn't match everything`)
+	}
+	if parseHostList("").Match("example.com") {
+		t.Error("an empty list matches")
+	}
+}
+
+func TestHostListMatchAddr(t *testing.T) {
+	list := parseHostList("10.0.0.0/8,example.com")
+	tests := []struct {
+		host string
+		ip   net.IP
+		want bool
+	}{
+		{"intranet.corp:443", net.ParseIP("10.9.8.7"), true},
+		{"intranet.corp:443", net.ParseIP("172.16.0.1"), false},
+		{"intranet.corp:443", nil, false},
+		{"example.com:443", net.ParseIP("172.16.0.1"), true},
+	}
+	for _, tt := range tests {
+		if got := list.MatchAddr(tt.host, tt.ip); got != tt.want {
+			t.Errorf("MatchAddr(%q, %v) = %v, want %v", tt.host, tt.ip, got, tt.want)
+		}
+	}
+}
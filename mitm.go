@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// serveMITM reads decrypted HTTP/1.1 requests from the client and forwards them
+// through the upstream pool one transaction at a time, until the client closes.
+// ctx carries the upstreamTarget the requests are forwarded to.
+func (p *Proxy) serveMITM(ctx context.Context, client net.Conn, host string) {
+	clientReader := bufio.NewReader(client)
+	var clientTLS *tls.ConnectionState
+	if tlsConn, ok := client.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		clientTLS = &state
+	}
+
+	for {
+		client.SetReadDeadline(deadline(p.timeouts.idle))
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			if !isClosedConnError(err) {
+				log.Printf("Failed to read request from client for host %s: %v\n", host, asTimeout(err, phaseClientIdle, p.timeouts.idle))
+			}
+			return
+		}
+		client.SetReadDeadline(time.Time{})
+		req.RemoteAddr = client.RemoteAddr().String()
+		req.TLS = clientTLS
+
+		// Requests inside the tunnel are origin-form; rebuild the absolute URL
+		req.URL.Scheme = "https"
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = host
+		}
+
+		keepAlive, err := p.forwardMITM(req.WithContext(ctx), client, clientReader)
+		if err != nil {
+			if !isClosedConnError(err) {
+				log.Printf("HTTPS %s %s failed: %v\n", req.Method, req.URL, err)
+			}
+			return
+		}
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// forwardMITM performs a single request/response exchange for the client and
+// reports whether the client connection may carry further requests
+func (p *Proxy) forwardMITM(req *http.Request, client net.Conn, clientReader *bufio.Reader) (keepAlive bool, err error) {
+	start := time.Now()
+
+	// An upgraded connection outlives the transaction, and has the idle timeout instead
+	limit := p.timeouts.transaction
+	if isUpgradeRequest(req) {
+		limit = 0
+	}
+	ctx, cancel := withTimeout(req.Context(), limit)
+	defer cancel()
+
+	rec := p.sessions.begin(req, "https")
+	var recErr error
+	defer func() {
+		if recErr == nil && !isClosedConnError(err) {
+			recErr = err
+		}
+		rec.finish(recErr)
+	}()
+	ctx = rec.trace(ctx)
+	ctx, progress := traceProgress(ctx)
+
+	// The client's connection preferences don't apply to the pooled upstream
+	clientClose := req.Close
+	outReq := req.Clone(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			return writeInterimResponse(client, code, http.Header(header))
+		},
+	}))
+	outReq.RequestURI = ""
+	p.prepareRequest(outReq, req, "https")
+	rec.captureRequest(outReq)
+
+	reqLog := teeRequestBody(outReq, "HTTPS Request Body")
+	resp, err := p.pool.RoundTrip(outReq)
+	reqLog.Close()
+	if err != nil {
+		recErr = p.timeouts.roundTripError(ctx, progress, err)
+		log.Printf("HTTPS %s %s failed: %v\n", req.Method, req.URL, recErr)
+		writeErrorResponse(client, req, upstreamErrorStatus(recErr), recErr)
+		return false, nil
+	}
+	defer resp.Body.Close()
+
+	logTransaction("HTTPS", req, resp, time.Since(start))
+	rec.response(resp)
+
+	p.prepareResponse(resp)
+
+	// After a protocol switch the connection no longer carries HTTP/1.1. The
+	// transport hands the switched upstream connection over as the body.
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		upstream, ok := resp.Body.(io.ReadWriteCloser)
+		if !ok {
+			return false, errors.New("upgraded connection is not writable")
+		}
+		if err := writeInterimResponse(client, resp.StatusCode, resp.Header); err != nil {
+			return false, err
+		}
+		recErr = relayUpgraded(req.URL.String(), resp, client, clientReader, upstream, upstream, p.timeouts.idle, rec)
+		return false, nil
+	}
+
+	// The response may have arrived over HTTP/2 or from a connection the
+	// upstream is about to close; neither is the client's concern
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	resp.Close = clientClose
+	if resp.ContentLength == -1 && len(resp.TransferEncoding) == 0 {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	if printBody {
+		bodyLog := bodyLogWriter("HTTPS Response Body", resp.Header)
+		defer bodyLog.Close()
+		resp.Body = readCloser{io.TeeReader(resp.Body, bodyLog), resp.Body}
+	}
+	if err := resp.Write(client); err != nil {
+		return false, p.timeouts.bodyError(ctx, err)
+	}
+	return !clientClose, nil
+}
+
+// writeInterimResponse writes a 1xx response, which has no body, to the client
+func writeInterimResponse(w io.Writer, code int, header http.Header) error {
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code)); err != nil {
+		return err
+	}
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// writeErrorResponse reports a failure to forward req to the client, closing the connection
+func writeErrorResponse(w io.Writer, req *http.Request, code int, err error) error {
+	body := err.Error() + "\n"
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Request:       req,
+	}
+	return resp.Write(w)
+}
+
+// relayUpgraded carries the connection after a protocol switch, decoding it when
+// it became a WebSocket, and returns the error which ended it other than either
+// side closing. The readers may hold bytes already buffered from either side.
+func relayUpgraded(url string, resp *http.Response, client io.WriteCloser, clientReader io.Reader, upstream io.WriteCloser, upstreamReader io.Reader, idle time.Duration, rec *recording) error {
+	var err error
+	if isWebSocketUpgrade(resp) {
+		err = relayWebSocket(url, resp, client, clientReader, upstream, upstreamReader, idle, rec)
+	} else {
+		err = relay(client, clientReader, upstream, upstreamReader, idle)
+	}
+	if err != nil && !isClosedConnError(err) {
+		log.Printf("Upgraded connection for %s failed: %v\n", url, err)
+		return err
+	}
+	return nil
+}
+
+// relay copies raw bytes between the client and upstream until both directions are done
+func relay(client io.WriteCloser, clientReader io.Reader, upstream io.WriteCloser, upstreamReader io.Reader, idle time.Duration) error {
+	return tunnel(client, upstream, idle,
+		func(dst io.Writer) error { _, err := io.Copy(dst, clientReader); return err },
+		func(dst io.Writer) error { _, err := io.Copy(dst, upstreamReader); return err })
+}
+
+// tunnel runs both directions of a connection until each has finished, each copying
+// to the dst it is given. A direction which ends cleanly half-closes its destination,
+// so the peer sees the end of the stream while the other direction carries on. An
+// error in either direction closes both ends, so neither goroutine outlives the
+// tunnel, and is returned. So does a tunnel which carries no data for idle.
+func tunnel(client, upstream io.WriteCloser, idle time.Duration, toUpstream, toClient func(dst io.Writer) error) error {
+	var idled atomic.Bool
+	touch := func() {}
+	if idle > 0 {
+		timer := time.AfterFunc(idle, func() {
+			idled.Store(true)
+			client.Close()
+			upstream.Close()
+		})
+		defer timer.Stop()
+		touch = func() { timer.Reset(idle) }
+	}
+
+	errc := make(chan error, 2)
+	run := func(copy func(io.Writer) error, dst io.WriteCloser) {
+		err := copy(activityWriter{w: dst, touch: touch})
+		if err == nil {
+			err = closeWrite(dst)
+		}
+		errc <- err
+	}
+	go run(toUpstream, upstream)
+	go run(toClient, client)
+
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil && firstErr == nil {
+			firstErr = err
+			client.Close()
+			upstream.Close()
+		}
+	}
+	if idled.Load() {
+		return &timeoutError{phase: phaseTunnelIdle, limit: idle}
+	}
+	return firstErr
+}
+
+// closeWrite half-closes w when it supports that, such as a TCP or TLS connection.
+// Otherwise the other direction simply runs until its peer closes.
+func closeWrite(w io.Writer) error {
+	if cw, ok := w.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// isClosedConnError reports whether err just means the peer went away
+func isClosedConnError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)
+}
+
+// readCloser pairs a wrapped Reader with the Closer of the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
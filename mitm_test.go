@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestProxy serves a proxy trusting upstream's certificate, returning it and
+// the address clients reach it at
+func startTestProxy(t *testing.T, upstream *httptest.Server) (*Proxy, string) {
+	t.Helper()
+	var roots []*x509.Certificate
+	if upstream != nil && upstream.TLS != nil {
+		roots = append(roots, upstream.Certificate())
+	}
+	p := newTestProxy(t, roots...)
+	s := httptest.NewServer(p)
+	t.Cleanup(s.Close)
+	return p, s.Listener.Addr().String()
+}
+
+// connectTunnel opens a CONNECT tunnel to target through the proxy at proxyAddr
+func connectTunnel(t *testing.T, proxyAddr, target string) (net.Conn, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, resp
+}
+
+// interceptTunnel opens a CONNECT tunnel to upstream and completes a TLS handshake
+// through it, trusting the proxy's CA and offering protos
+func interceptTunnel(t *testing.T, p *Proxy, proxyAddr string, upstream *httptest.Server, protos ...string) *tls.Conn {
+	t.Helper()
+	conn, resp := connectTunnel(t, proxyAddr, upstream.Listener.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s", resp.Status)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(p.ca.cert)
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1", NextProtos: protos})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return tlsConn
+}
+
+// TestServeMITM sends pipelined keep-alive requests, one with a chunked body, through
+// an intercepted tunnel, then one asking to close the connection
+func TestServeMITM(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s host=%s body=%s", r.Method, r.URL.Path, r.Host, body)
+	}))
+	defer upstream.Close()
+	p, proxyAddr := startTestProxy(t, upstream)
+	conn := interceptTunnel(t, p, proxyAddr, upstream, "http/1.1")
+
+	requests := "GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"POST /second HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n" +
+		"GET /third HTTP/1.1\r\nHost: other.example\r\nConnection: close\r\n\r\n"
+	if _, err := io.WriteString(conn, requests); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	for i, want := range []string{
+		"GET /first host=example.com body=",
+		"POST /second host=example.com body=hello world",
+		"GET /third host=other.example body=",
+	} {
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("response %d: got %q, want %q", i, body, want)
+		}
+		if last := i == 2; resp.Close != last {
+			t.Errorf("response %d: Close = %v, want %v", i, resp.Close, last)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after Connection: close (%v)", err)
+	}
+}
+
+// TestServeMITMMalformed checks a request which can't be parsed ends the tunnel
+func TestServeMITMMalformed(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	p, proxyAddr := startTestProxy(t, upstream)
+	conn := interceptTunnel(t, p, proxyAddr, upstream, "http/1.1")
+
+	io.WriteString(conn, "NOT HTTP\r\n\r\n")
+	if data, err := io.ReadAll(conn); len(data) != 0 || (err != nil && !strings.Contains(err.Error(), "EOF")) {
+		t.Errorf("got %q, %v; want the tunnel closed", data, err)
+	}
+}
+
+func TestConnectReply(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.NotFoundHandler())
+	defer upstream.Close()
+	_, proxyAddr := startTestProxy(t, upstream)
+
+	_, resp := connectTunnel(t, proxyAddr, upstream.Listener.Addr().String())
+	if resp.StatusCode != http.StatusOK || resp.Status != "200 Connection Established" {
+		t.Errorf("got %q, want 200 Connection Established", resp.Status)
+	}
+
+	// A target which refuses the connection is reported before the tunnel is accepted
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	if _, resp := connectTunnel(t, proxyAddr, closed); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("unreachable target got %s, want 502", resp.Status)
+	}
+}
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errors.New("connection refused"), http.StatusBadGateway},
+		{&timeoutError{phase: phaseDial, limit: time.Second}, http.StatusGatewayTimeout},
+		{fmt.Errorf("dialing: %w", &timeoutError{phase: phaseDial, limit: time.Second}), http.StatusGatewayTimeout},
+		{errProxyLoop, http.StatusLoopDetected},
+	}
+	for _, tt := range tests {
+		if got := upstreamErrorStatus(tt.err); got != tt.want {
+			t.Errorf("upstreamErrorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	dialed.SetDeadline(time.Now().Add(10 * time.Second))
+	accepted.SetDeadline(time.Now().Add(10 * time.Second))
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+// TestRelayHalfClose checks a client which finishes sending still receives the
+// whole response, as in a request followed by shutdown(SHUT_WR)
+func TestRelayHalfClose(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	upstreamSide, upstream := tcpPair(t)
+
+	done := make(chan error, 1)
+	go func() { done <- relay(clientSide, clientSide, upstreamSide, upstreamSide, time.Minute) }()
+
+	io.WriteString(client, "request")
+	client.CloseWrite()
+	got, err := io.ReadAll(upstream)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("upstream read %q, %v", got, err)
+	}
+
+	// The other direction carries on after the client's half-close
+	io.WriteString(upstream, "response")
+	upstream.CloseWrite()
+	if got, err = io.ReadAll(client); err != nil || string(got) != "response" {
+		t.Fatalf("client read %q, %v", got, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("relay returned %v", err)
+	}
+}
+
+func TestRelayIdle(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	upstreamSide, upstream := tcpPair(t)
+
+	err := relay(clientSide, clientSide, upstreamSide, upstreamSide, 50*time.Millisecond)
+	var te *timeoutError
+	if !errors.As(err, &te) || te.phase != phaseTunnelIdle {
+		t.Fatalf("got %v, want a %s timeout", err, phaseTunnelIdle)
+	}
+	// Both ends were closed
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client read %v, want EOF", err)
+	}
+	if _, err := upstream.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("upstream read %v, want EOF", err)
+	}
+}
+
+// TestTunnelError checks an error in one direction closes both ends, ending the
+// other direction too, and is returned
+func TestTunnelError(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	upstreamSide, upstream := tcpPair(t)
+
+	failure := errors.New("decoding failed")
+	err := tunnel(clientSide, upstreamSide, time.Minute,
+		func(dst io.Writer) error { return failure },
+		func(dst io.Writer) error { _, err := io.Copy(dst, upstreamSide); return err })
+	if err != failure {
+		t.Fatalf("got %v, want %v", err, failure)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client read %v, want EOF", err)
+	}
+	if _, err := upstream.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("upstream read %v, want EOF", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// originalDst recovers the destination a connection was addressed to before
+// it was redirected to the proxy by the nftables rules
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	ipv4 := tc.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	err = raw.Control(func(fd uintptr) {
+		if ipv4 {
+			// The kernel fills a sockaddr_in, which happens to fit in an ipv6_mreq
+			var mreq *unix.IPv6Mreq
+			if mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST); sockErr == nil {
+				b := mreq.Multiaddr
+				dst = &net.TCPAddr{
+					IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+					Port: int(binary.BigEndian.Uint16(b[2:4])),
+				}
+			}
+			return
+		}
+
+		// IP6T_SO_ORIGINAL_DST shares its value with SO_ORIGINAL_DST and fills a sockaddr_in6
+		var info *unix.IPv6MTUInfo
+		if info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST); sockErr == nil {
+			port := binary.NativeEndian.AppendUint16(nil, info.Addr.Port)
+			dst = &net.TCPAddr{
+				IP:   net.IP(info.Addr.Addr[:]),
+				Port: int(binary.BigEndian.Uint16(port)),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("failed to read original destination: %v", sockErr)
+	}
+	return dst, nil
+}
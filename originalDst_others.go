@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDst is only supported with the Linux nftables redirect
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent proxying is not supported on this platform")
+}
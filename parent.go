@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// parseParentProxy parses the -upstream-proxy URL, which may be empty to connect directly
+func parseParentProxy(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy %q: %v", s, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("upstream proxy %q must be an http://, https:// or socks5:// URL", s)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream proxy %q has no host", s)
+	}
+	return u, nil
+}
+
+// parentAddr returns the host:port of a parent proxy, using the scheme's usual port
+// when none is given
+func parentAddr(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(u.Hostname(), "1080")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// parentFor returns the parent proxy connections to host, reached at addr, go
+// through, or nil when they go direct because there is no parent or either is
+// listed in -upstream-proxy-bypass. Both are host:port; for transparently
+// redirected connections host is the server name the client asked for and addr
+// the IP address it was headed to.
+func (p *Proxy) parentFor(host, addr string) *url.URL {
+	if p.parentProxy == nil || p.parentBypass.Match(host) || p.parentBypass.Match(addr) {
+		return nil
+	}
+	return p.parentProxy
+}
+
+// transportProxy is the Proxy function of the transport used by handleHTTP. SOCKS
+// parents are left to dialTransport, which resolves names as their scheme says.
+func (p *Proxy) transportProxy(req *http.Request) (*url.URL, error) {
+	if parent := p.parentFor(req.URL.Host, req.URL.Host); parent != nil && !isSOCKS(parent) {
+		return parent, nil
+	}
+	return nil, nil
+}
+
+// dialTransport is the DialContext of the transport used by handleHTTP
+func (p *Proxy) dialTransport(ctx context.Context, network, addr string) (net.Conn, error) {
+	if parent := p.parentFor(addr, addr); parent != nil && isSOCKS(parent) {
+		return p.dialUpstream(ctx, addr, addr)
+	}
+	return p.dialContext(ctx, network, addr)
+}
+
+func isSOCKS(u *url.URL) bool {
+	return u.Scheme == "socks5" || u.Scheme == "socks5h"
+}
+
+// dialUpstream opens a raw connection to host for intercepted or relayed traffic,
+// through the parent proxy when one applies. Direct connections are made to addr.
+func (p *Proxy) dialUpstream(ctx context.Context, host, addr string) (net.Conn, error) {
+	parent := p.parentFor(host, addr)
+	if parent == nil {
+		return p.dialContext(ctx, "tcp", addr)
+	}
+
+	// The dial timeout covers the whole negotiation with the parent
+	ctx, cancel := withTimeout(ctx, p.timeouts.dial)
+	defer cancel()
+	conn, err := p.dialParent(ctx, parent, host, addr)
+	return conn, asTimeout(err, phaseDial, p.timeouts.dial)
+}
+
+// dialParent opens a tunnel to host through the parent proxy. socks5:// parents
+// are given an IP address, addr's when it has one, and the others the host name.
+func (p *Proxy) dialParent(ctx context.Context, parent *url.URL, host, addr string) (net.Conn, error) {
+	if isSOCKS(parent) {
+		target := host
+		if parent.Scheme == "socks5" {
+			var err error
+			if target, err = resolveAddr(ctx, host, addr); err != nil {
+				return nil, err
+			}
+		}
+		var auth *proxy.Auth
+		if parent.User != nil {
+			password, _ := parent.User.Password()
+			auth = &proxy.Auth{User: parent.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", parentAddr(parent), auth, dialerFunc(p.dialContext))
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", target)
+	}
+	return p.dialConnect(ctx, parent, host)
+}
+
+// resolveAddr returns addr if it is an IP address and port, and otherwise host
+// with its name resolved locally
+func resolveAddr(ctx context.Context, host, addr string) (string, error) {
+	if net.ParseIP(hostOnly(addr)) != nil {
+		return addr, nil
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return "", err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].IP.String(), port), nil
+}
+
+// dialConnect opens a tunnel to addr through an HTTP(S) parent proxy using CONNECT
+func (p *Proxy) dialConnect(ctx context.Context, parent *url.URL, addr string) (net.Conn, error) {
+	conn, err := p.dialContext(ctx, "tcp", parentAddr(parent))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if parent.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: parent.Hostname(), RootCAs: p.upstreamRoots})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with upstream proxy %s failed: %w", parent.Host, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if parent.User != nil {
+		password, _ := parent.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(parent.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from upstream proxy %s: %w", parent.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s refused CONNECT to %s: %s", parent.Host, addr, resp.Status)
+	}
+	// The reader may already hold the first bytes from the target server
+	return &peekedConn{Conn: conn, reader: br}, nil
+}
+
+// dialerFunc adapts a dial function to the Dialer interfaces of golang.org/x/net/proxy
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pinnedTTL is how long a host whose client rejected our certificate is passed
+// through before interception is tried again. A client which merely doesn't trust
+// the CA looks just the same, so the decision isn't made for good.
+const pinnedTTL = 10 * time.Minute
+
+// tlsPolicy decides which TLS connections are intercepted and which are tunnelled
+// to the target server untouched, for clients which pin certificates or otherwise
+// must not be interfered with
+type tlsPolicy struct {
+	intercept     hostList // when set, only these hosts are intercepted
+	passthrough   hostList
+	detectPinning bool
+
+	mu     sync.Mutex
+	pinned map[string]time.Time // hosts whose clients rejected a forged certificate, until when
+}
+
+func newTLSPolicy(intercept, passthrough string, detectPinning bool) *tlsPolicy {
+	return &tlsPolicy{
+		intercept:     parseHostList(intercept),
+		passthrough:   parseHostList(passthrough),
+		detectPinning: detectPinning,
+		pinned:        make(map[string]time.Time),
+	}
+}
+
+// Passthrough reports whether the connection to host, reached at ip, should be
+// tunnelled untouched, and why
+func (t *tlsPolicy) Passthrough(host string, ip net.IP) (bool, string) {
+	if t.passthrough.MatchAddr(host, ip) {
+		return true, "listed in -passthrough-hosts"
+	}
+	if len(t.intercept) > 0 && !t.intercept.MatchAddr(host, ip) {
+		return true, "not listed in -intercept-hosts"
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until, ok := t.pinned[hostOnly(host)]; ok {
+		if time.Now().Before(until) {
+			return true, fmt.Sprintf("client rejected our certificate earlier (until %s)", until.Format(time.TimeOnly))
+		}
+		delete(t.pinned, hostOnly(host))
+		log.Printf("Trying to intercept %s again, %v after a client rejected our certificate\n", hostOnly(host), pinnedTTL)
+	}
+	return false, ""
+}
+
+// ClientHandshakeFailed records a client aborting the handshake after being shown a
+// certificate it should trust, which usually means the host's certificate is pinned.
+// The host is passed through for pinnedTTL from then on.
+func (t *tlsPolicy) ClientHandshakeFailed(host string, err error) {
+	// A client which merely went quiet hasn't rejected anything
+	var netErr net.Error
+	if !t.detectPinning || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.pinned[hostOnly(host)]; !ok {
+		t.pinned[hostOnly(host)] = time.Now().Add(pinnedTTL)
+		log.Printf("Client rejected the certificate for %s (%v); it may be pinned, so %s will be passed through for %v\n", host, err, hostOnly(host), pinnedTTL)
+	}
+}
+
+// watchCertificate wraps the GetCertificate callback of cfg, returning a function
+// which reports whether a certificate has been presented to the client. Clients
+// reject certificates in different ways (an alert, sometimes unencrypted, or just
+// hanging up), so any failure after that point is taken as a rejection.
+func watchCertificate(cfg *tls.Config) func() bool {
+	var presented atomic.Bool
+	getCertificate := cfg.GetCertificate
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := getCertificate(hello)
+		presented.Store(err == nil)
+		return cert, err
+	}
+	return presented.Load
+}
+
+// passThrough relays a TLS connection between client and the target server
+// without decrypting it
+func passThrough(client, upstream net.Conn, host, reason string, idle time.Duration) {
+	log.Printf("Passing TLS for %s through untouched: %s\n", host, reason)
+	if err := relay(client, client, upstream, upstream, idle); err != nil && !isClosedConnError(err) {
+		log.Printf("Passthrough connection for %s failed: %v\n", host, err)
+		return
+	}
+	log.Printf("Passthrough connection for %s closed\n", host)
+}
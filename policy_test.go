@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTLSPolicyPassthrough(t *testing.T) {
+	tests := []struct {
+		name        string
+		intercept   string
+		passthrough string
+		host        string
+		ip          net.IP
+		want        bool
+	}{
+		{name: "default", host: "example.com:443", want: false},
+		{name: "listed", passthrough: "*.bank.test", host: "www.bank.test:443", want: true},
+		{name: "listed by address", passthrough: "10.0.0.0/8", host: "db.corp:443", ip: net.ParseIP("10.0.0.5"), want: true},
+		{name: "intercepted", intercept: "example.com", host: "example.com:443", want: false},
+		{name: "not intercepted", intercept: "example.com", host: "other.test:443", want: true},
+		{name: "passthrough wins", intercept: "*", passthrough: "example.com", host: "example.com:443", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := newTLSPolicy(tt.intercept, tt.passthrough, false)
+			if got, reason := policy.Passthrough(tt.host, tt.ip); got != tt.want {
+				t.Errorf("Passthrough(%q, %v) = %v (%s), want %v", tt.host, tt.ip, got, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSPolicyPinning(t *testing.T) {
+	rejected := errors.New("remote error: tls: bad certificate")
+
+	off := newTLSPolicy("", "", false)
+	off.ClientHandshakeFailed("app.test:443", rejected)
+	if pass, _ := off.Passthrough("app.test:443", nil); pass {
+		t.Error("host passed through with detection off")
+	}
+
+	on := newTLSPolicy("", "", true)
+	on.ClientHandshakeFailed("quiet.test:443", os.ErrDeadlineExceeded)
+	if pass, _ := on.Passthrough("quiet.test:443", nil); pass {
+		t.Error("host passed through after the client timed out")
+	}
+
+	on.ClientHandshakeFailed("app.test:443", rejected)
+	if pass, _ := on.Passthrough("app.test:8443", nil); !pass {
+		t.Error("host not passed through after its client rejected our certificate")
+	}
+
+	// Once the entry expires, interception is tried again
+	on.mu.Lock()
+	on.pinned["app.test"] = time.Now().Add(-time.Second)
+	on.mu.Unlock()
+	if pass, _ := on.Passthrough("app.test:443", nil); pass {
+		t.Error("host still passed through after pinnedTTL")
+	}
+}
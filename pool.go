@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Defaults for the -upstream-* pool flags
+const (
+	defaultMaxIdlePerHost      = 4
+	defaultUpstreamIdleTimeout = 90 * time.Second
+)
+
+// upstreamTargetKey is the request context key holding the *upstreamTarget that
+// decrypted requests are forwarded to
+type upstreamTargetKey struct{}
+
+// upstreamTarget is the server an intercepted connection is headed for: the name
+// its certificate is verified against and the address it is reached at
+type upstreamTarget struct {
+	host       string // as requested, which statistics are kept by
+	serverName string
+	addr       string
+
+	info *upstreamInfo // what is known about the server, nil until verified
+	conn net.Conn      // raw connection dialed to verify the server, if info wasn't known
+}
+
+func (t *upstreamTarget) key() string {
+	return t.serverName + "|" + t.addr
+}
+
+// poolAddr is the host:port the transports keep the target's connections under in
+// place of the request's own. The Host header is the client's to choose, so pooling
+// by it would let a tunnel to one server hand its connection to tunnels verified
+// for another; this names the verified server name and address instead.
+func (t *upstreamTarget) poolAddr() string {
+	_, port, _ := net.SplitHostPort(t.addr)
+	return net.JoinHostPort(hex.EncodeToString([]byte(t.key()))+".upstream.invalid", port)
+}
+
+// Close closes the raw connection, unless it was passed on to the pool or a passthrough
+func (t *upstreamTarget) Close() {
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
+
+// upstreamInfo is the outcome of the latest handshake with a server
+type upstreamInfo struct {
+	verifyErr error
+	ip        net.IP // nil when connecting through a parent proxy
+	checked   time.Time
+}
+
+// connectTarget prepares to intercept a connection to host at addr. Servers
+// verified recently are trusted to still be reachable; others are dialed first,
+// so a failure can be reported to the client before its tunnel is accepted.
+func (p *Proxy) connectTarget(host, addr string) (*upstreamTarget, error) {
+	t := &upstreamTarget{host: host, serverName: hostOnly(host), addr: addr}
+	if t.info = p.pool.lookup(t); t.info != nil {
+		return t, nil
+	}
+	conn, err := p.dialTarget(host, addr)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	return t, nil
+}
+
+// upstreamPool forwards the decrypted requests of every intercepted connection over
+// a shared set of upstream connections, so a new tunnel from the client doesn't cost
+// a new TCP and TLS handshake with the server. HTTP/1.1 connections are kept alive
+// and HTTP/2 connections multiplexed by an http.Transport, and TLS sessions are
+// resumed where the server allows.
+type upstreamPool struct {
+	proxy     *Proxy
+	transport *http.Transport
+	http1     *http.Transport // for protocol switches, which HTTP/2 can't carry
+	sessions  tls.ClientSessionCache
+	infoTTL   time.Duration
+
+	mu     sync.Mutex
+	hosts  map[string]*upstreamInfo // by upstreamTarget.key
+	spares map[string]*tls.Conn     // verified connections awaiting their first request
+	stats  map[string]*hostStats    // by upstreamTarget.host
+
+	// Hosts come and go with what clients ask for, so entries unused for infoTTL are
+	// swept from hosts and stats, their counts kept in retired for the totals
+	retired   hostStats
+	nextSweep time.Time
+}
+
+// hostStats counts the pool's work for one server
+type hostStats struct {
+	Requests    int64 `json:"requests"`
+	ReusedConns int64 `json:"reusedConns"`
+	Dials       int64 `json:"dials"`
+	TLSResumed  int64 `json:"tlsResumed"`
+	SpareConns  int64 `json:"spareConnsUsed"`
+
+	lastUsed time.Time
+}
+
+func (s *hostStats) add(other *hostStats) {
+	s.Requests += other.Requests
+	s.ReusedConns += other.ReusedConns
+	s.Dials += other.Dials
+	s.TLSResumed += other.TLSResumed
+	s.SpareConns += other.SpareConns
+}
+
+func newUpstreamPool(p *Proxy, maxIdlePerHost int, idleTimeout time.Duration) *upstreamPool {
+	u := &upstreamPool{
+		proxy:    p,
+		sessions: tls.NewLRUClientSessionCache(0),
+		infoTTL:  idleTimeout,
+		hosts:    make(map[string]*upstreamInfo),
+		spares:   make(map[string]*tls.Conn),
+		stats:    make(map[string]*hostStats),
+	}
+	u.transport = &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return u.dialTLS(ctx, addr, false)
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		IdleConnTimeout:       idleTimeout,
+		ResponseHeaderTimeout: p.timeouts.responseHeader,
+		ExpectContinueTimeout: 1 * time.Second,
+		// Bodies are relayed as the server sent them
+		DisableCompression: true,
+	}
+	u.http1 = u.transport.Clone()
+	u.http1.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return u.dialTLS(ctx, addr, true)
+	}
+	u.http1.ForceAttemptHTTP2 = false
+	u.http1.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	return u
+}
+
+// RoundTrip forwards a decrypted request to the server in its upstreamTargetKey
+func (u *upstreamPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	target, ok := req.Context().Value(upstreamTargetKey{}).(*upstreamTarget)
+	if ok {
+		host = target.host
+	}
+	u.record(host, func(s *hostStats) { s.Requests++ })
+
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				u.record(host, func(s *hostStats) { s.ReusedConns++ })
+			}
+		},
+	})
+	out := req.WithContext(ctx)
+	if target != nil {
+		if out.Host == "" {
+			out.Host = req.URL.Host
+		}
+		url := *req.URL
+		url.Host = target.poolAddr()
+		out.URL = &url
+	}
+	if isUpgradeRequest(req) {
+		return u.http1.RoundTrip(out)
+	}
+	return u.transport.RoundTrip(out)
+}
+
+// lookup returns what is known about the target, if it was verified recently
+func (u *upstreamPool) lookup(t *upstreamTarget) *upstreamInfo {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	info := u.hosts[t.key()]
+	if info == nil || time.Since(info.checked) > u.infoTTL {
+		return nil
+	}
+	return info
+}
+
+// verify completes the TLS handshake on the target's raw connection and checks the
+// server's certificate, then keeps the connection for the first request forwarded
+func (u *upstreamPool) verify(ctx context.Context, t *upstreamTarget) error {
+	conn, info, err := u.handshake(ctx, t.conn, t, false)
+	if err != nil {
+		return err
+	}
+	log.Printf("TLS handshake with target server succeeded for host %s\n", t.serverName)
+	t.info = info
+	t.conn = nil
+	u.putSpare(t, conn)
+	return nil
+}
+
+// dialTLS is the transports' dialer. It hands out the connection left over from
+// verifying the target where there is one, and dials a new one otherwise.
+func (u *upstreamPool) dialTLS(ctx context.Context, addr string, http1Only bool) (net.Conn, error) {
+	t, ok := ctx.Value(upstreamTargetKey{}).(*upstreamTarget)
+	if !ok {
+		t = &upstreamTarget{host: addr, serverName: hostOnly(addr), addr: addr}
+	}
+
+	if conn := u.takeSpare(t, http1Only); conn != nil {
+		u.record(t.host, func(s *hostStats) { s.SpareConns++ })
+		return conn, nil
+	}
+
+	raw, err := u.proxy.dialUpstream(ctx, t.host, t.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, info, err := u.handshake(ctx, raw, t, http1Only)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	// A certificate may only fail if the client was shown one which failed too
+	if info.verifyErr != nil && (t.info == nil || t.info.verifyErr == nil) {
+		conn.Close()
+		return nil, fmt.Errorf("certificate of target server %s failed verification: %v", t.serverName, info.verifyErr)
+	}
+	return conn, nil
+}
+
+// handshake performs the TLS handshake with the server over raw and records the
+// outcome of verifying its certificate
+func (u *upstreamPool) handshake(ctx context.Context, raw net.Conn, t *upstreamTarget, http1Only bool) (*tls.Conn, *upstreamInfo, error) {
+	protos := []string{"h2", "http/1.1"}
+	if http1Only {
+		protos = []string{"http/1.1"}
+	}
+	conn := tls.Client(raw, &tls.Config{
+		InsecureSkipVerify: true, // Verified by verifyUpstream instead, so failures can be reported to the client
+		ServerName:         t.serverName,
+		NextProtos:         protos,
+		ClientSessionCache: u.sessions,
+	})
+	limit := u.proxy.timeouts.tlsHandshake
+	handshakeCtx, cancel := withTimeout(ctx, limit)
+	defer cancel()
+	if err := conn.HandshakeContext(handshakeCtx); err != nil {
+		return nil, nil, fmt.Errorf("TLS handshake with target server failed: %w", asTimeout(err, phaseUpstreamHandshake, limit))
+	}
+
+	state := conn.ConnectionState()
+	info := &upstreamInfo{
+		verifyErr: u.proxy.verifyUpstream(state, t.serverName),
+		checked:   time.Now(),
+	}
+	if tcpAddr, ok := raw.RemoteAddr().(*net.TCPAddr); ok && u.proxy.parentFor(t.host, t.addr) == nil {
+		info.ip = tcpAddr.IP
+	}
+	u.mu.Lock()
+	u.hosts[t.key()] = info
+	u.mu.Unlock()
+	u.record(t.host, func(s *hostStats) {
+		s.Dials++
+		if state.DidResume {
+			s.TLSResumed++
+		}
+	})
+	return conn, info, nil
+}
+
+// putSpare keeps conn for the target's next dial, for as long as an idle connection would be kept
+func (u *upstreamPool) putSpare(t *upstreamTarget, conn *tls.Conn) {
+	key := t.key()
+	u.mu.Lock()
+	if old := u.spares[key]; old != nil {
+		old.Close()
+	}
+	u.spares[key] = conn
+	u.mu.Unlock()
+
+	time.AfterFunc(u.infoTTL, func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if u.spares[key] == conn {
+			delete(u.spares, key)
+			conn.Close()
+		}
+	})
+}
+
+// takeSpare returns the target's spare connection, if it can carry the request
+func (u *upstreamPool) takeSpare(t *upstreamTarget, http1Only bool) *tls.Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	conn := u.spares[t.key()]
+	if conn == nil || (http1Only && conn.ConnectionState().NegotiatedProtocol == "h2") {
+		return nil
+	}
+	delete(u.spares, t.key())
+	return conn
+}
+
+// Close closes the idle and spare connections. Connections in use are closed by their transactions.
+func (u *upstreamPool) Close() {
+	u.transport.CloseIdleConnections()
+	u.http1.CloseIdleConnections()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, conn := range u.spares {
+		conn.Close()
+		delete(u.spares, key)
+	}
+}
+
+func (u *upstreamPool) record(host string, f func(*hostStats)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	if now.After(u.nextSweep) {
+		u.sweep(now)
+	}
+	s := u.stats[host]
+	if s == nil {
+		s = new(hostStats)
+		u.stats[host] = s
+	}
+	s.lastUsed = now
+	f(s)
+}
+
+// sweep forgets the servers which haven't been verified or used for infoTTL, at
+// most once per infoTTL. u.mu must be held.
+func (u *upstreamPool) sweep(now time.Time) {
+	ttl := u.infoTTL
+	if ttl <= 0 {
+		ttl = defaultUpstreamIdleTimeout
+	}
+	u.nextSweep = now.Add(ttl)
+	for key, info := range u.hosts {
+		if now.Sub(info.checked) > ttl {
+			delete(u.hosts, key)
+		}
+	}
+	for host, s := range u.stats {
+		if now.Sub(s.lastUsed) > ttl {
+			u.retired.add(s)
+			delete(u.stats, host)
+		}
+	}
+}
+
+// serveStats reports the pool's statistics as JSON
+func (u *upstreamPool) serveStats(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	totals := u.retired
+	hosts := make(map[string]hostStats, len(u.stats))
+	for name, s := range u.stats {
+		hosts[name] = *s
+		totals.add(s)
+	}
+	report := struct {
+		Totals        hostStats            `json:"totals"`
+		Hosts         map[string]hostStats `json:"hosts"`
+		VerifiedHosts int                  `json:"verifiedHosts"`
+		SpareConns    int                  `json:"spareConns"`
+	}{totals, hosts, len(u.hosts), len(u.spares)}
+	u.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+// isUpgradeRequest reports whether req asks to switch protocols
+func isUpgradeRequest(req *http.Request) bool {
+	return hasToken(req.Header, "Connection", "upgrade")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestProxy(t *testing.T, roots ...*x509.Certificate) *Proxy {
+	t.Helper()
+	ca, err := newUntrustedCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newProxy(ca, proxyConfig{
+		verifyFailure:       verifyFailureUntrusted,
+		upstreamMaxIdle:     defaultMaxIdlePerHost,
+		upstreamIdleTimeout: time.Minute,
+		timeouts: timeouts{
+			dial:           5 * time.Second,
+			tlsHandshake:   5 * time.Second,
+			responseHeader: 5 * time.Second,
+			idle:           5 * time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.upstreamRoots = x509.NewCertPool()
+	for _, cert := range roots {
+		p.upstreamRoots.AddCert(cert)
+	}
+	t.Cleanup(p.pool.Close)
+	return p
+}
+
+// TestPoolKeysByTarget sends requests naming the same Host through tunnels to two
+// different servers. Each must reach the server its own tunnel was verified for,
+// even though the other tunnel left an idle connection behind for that Host.
+func TestPoolKeysByTarget(t *testing.T) {
+	newServer := func(name string) *httptest.Server {
+		s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	evil := newServer("evil")
+	bank := newServer("bank")
+	p := newTestProxy(t, evil.Certificate(), bank.Certificate())
+
+	// httptest certificates are issued for example.com
+	get := func(server *httptest.Server, host string) string {
+		target := &upstreamTarget{host: "example.com:443", serverName: "example.com", addr: server.Listener.Addr().String()}
+		ctx := context.WithValue(context.Background(), upstreamTargetKey{}, target)
+		req, _ := http.NewRequestWithContext(ctx, "GET", "https://"+host+"/", nil)
+		resp, err := p.pool.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	for i, tt := range []struct {
+		server *httptest.Server
+		host   string
+		want   string
+	}{
+		{evil, "bank.example.com", "evil"},
+		{bank, "bank.example.com", "bank"},
+		{evil, "bank.example.com", "evil"},
+		{bank, "evil.example.com", "bank"},
+	} {
+		if got := get(tt.server, tt.host); got != tt.want {
+			t.Errorf("request %d with Host %s reached %s, want %s", i, tt.host, got, tt.want)
+		}
+	}
+}
+
+// TestPoolKeepsHostHeader checks the Host header reaches the server unchanged
+func TestPoolKeepsHostHeader(t *testing.T) {
+	var gotHost string
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+	}))
+	defer s.Close()
+	p := newTestProxy(t, s.Certificate())
+
+	target := &upstreamTarget{host: "example.com:443", serverName: "example.com", addr: s.Listener.Addr().String()}
+	ctx := context.WithValue(context.Background(), upstreamTargetKey{}, target)
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://www.example.com/", nil)
+	resp, err := p.pool.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if gotHost != "www.example.com" {
+		t.Errorf("server saw Host %q, want www.example.com", gotHost)
+	}
+	if req.URL.Host != "www.example.com" {
+		t.Errorf("RoundTrip changed the caller's URL to %s", req.URL)
+	}
+}
+
+func TestPoolSweep(t *testing.T) {
+	u := newTestProxy(t).pool
+	u.record("old.example:443", func(s *hostStats) { s.Requests += 3 })
+	u.hosts["old.example|10.0.0.1:443"] = &upstreamInfo{checked: time.Now().Add(-2 * time.Minute)}
+	u.hosts["new.example|10.0.0.2:443"] = &upstreamInfo{checked: time.Now()}
+
+	// Once old.example has gone unused for longer than infoTTL, the next request sweeps it
+	u.mu.Lock()
+	u.stats["old.example:443"].lastUsed = time.Now().Add(-2 * time.Minute)
+	u.nextSweep = time.Time{}
+	u.mu.Unlock()
+	u.record("new.example:443", func(s *hostStats) { s.Requests++ })
+
+	if _, ok := u.stats["old.example:443"]; ok {
+		t.Error("stats of an idle host were kept")
+	}
+	if _, ok := u.hosts["old.example|10.0.0.1:443"]; ok {
+		t.Error("an expired verification was kept")
+	}
+	if _, ok := u.hosts["new.example|10.0.0.2:443"]; !ok {
+		t.Error("a recent verification was swept")
+	}
+
+	w := httptest.NewRecorder()
+	u.serveStats(w, httptest.NewRequest("GET", "/api/pool", nil))
+	var report struct {
+		Totals hostStats            `json:"totals"`
+		Hosts  map[string]hostStats `json:"hosts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Totals.Requests != 4 || len(report.Hosts) != 1 {
+		t.Errorf("got %d requests in total across %d hosts, want 4 across 1", report.Totals.Requests, len(report.Hosts))
+	}
+}
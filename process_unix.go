@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// processAlive reports whether a process with the given pid exists
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// fromTerminal reports whether sig was most likely typed at the terminal, and so
+// was delivered to our whole foreground process group rather than to us alone
+func fromTerminal(sig os.Signal) bool {
+	if sig != os.Interrupt {
+		return false
+	}
+	pgrp, err := unix.IoctlGetInt(int(os.Stdin.Fd()), unix.TIOCGPGRP)
+	return err == nil && pgrp == unix.Getpgrp()
+}
@@ -0,0 +1,33 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// stillActive is the exit code GetExitCodeProcess reports for a running process
+const stillActive = 259
+
+// processAlive reports whether a process with the given pid is still running
+func processAlive(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(h)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+// fromTerminal reports whether sig was most likely typed at the console. Ctrl+C
+// reaches every process attached to the console, so an interrupt always is.
+func fromTerminal(sig os.Signal) bool {
+	return sig == os.Interrupt
+}
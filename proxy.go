@@ -1,33 +1,93 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 var (
 	printHeaders bool
 	printBody    bool
 	uninstall    bool
+
+	printBodyLimit int
+	restore        bool
 )
 
 func main() {
+	var cfg proxyConfig
 	flag.BoolVar(&printHeaders, "print-headers", true, "Print HTTPS headers")
 	flag.BoolVar(&printBody, "print-body", false, "Print HTTPS body")
+	flag.IntVar(&printBodyLimit, "print-body-limit", defaultPrintBodyLimit, "bytes of each body printed with -print-body; longer bodies are truncated")
 	port := flag.Int("port", 8888, "the port on which the HTTP(S) proxy will run")
 	flag.BoolVar(&uninstall, "uninstall", false, "uninstall the given certificate")
+	flag.BoolVar(&restore, "restore", false, "restore system proxy settings left behind by a previous run, then exit")
+	scopeUID := flag.String("scope-uid", "", "only intercept traffic from this user name or uid (Linux)")
+	scopeGID := flag.String("scope-gid", "", "only intercept traffic from this group name or gid (Linux)")
+	scopeCgroup := flag.String("scope-cgroup", "", "only intercept traffic from processes in this cgroup v2 path (Linux)")
+	scopeUnit := flag.String("scope-unit", "", "only intercept traffic from this systemd unit (Linux)")
+	flag.StringVar(&cfg.upstreamCAFile, "upstream-ca", "", "PEM bundle of extra CAs trusted for upstream servers, besides the system roots")
+	flag.StringVar(&cfg.insecureHosts, "insecure-hosts", "", "comma separated hosts (*.example.com for subdomains) whose certificates are not verified")
+	flag.StringVar(&cfg.verifyFailure, "verify-failure", verifyFailureUntrusted, "when an upstream certificate fails verification, present an 'untrusted' certificate or an 'error' page to the client")
+	flag.StringVar(&cfg.upstreamProxy, "upstream-proxy", "", "parent proxy to send intercepted traffic through, as http://, https://, socks5:// (names resolved locally) or socks5h:// (names resolved by the parent) [user:password@]host:port")
+	flag.StringVar(&cfg.upstreamProxyBypass, "upstream-proxy-bypass", "", "comma separated hosts (*.example.com for subdomains) reached directly rather than through -upstream-proxy")
+	flag.StringVar(&cfg.interceptHosts, "intercept-hosts", "", "comma separated hosts (*.example.com for subdomains, or IP/CIDR ranges) to intercept; others are passed through (default all)")
+	flag.StringVar(&cfg.passthroughHosts, "passthrough-hosts", "", "comma separated hosts (*.example.com for subdomains, or IP/CIDR ranges) whose TLS is passed through without interception")
+	flag.BoolVar(&cfg.detectPinning, "detect-pinning", false, "pass hosts through for a while once a client rejects the certificate minted for them, as pinning clients do")
+	flag.IntVar(&cfg.upstreamMaxIdle, "upstream-max-idle-per-host", defaultMaxIdlePerHost, "idle connections kept open to each intercepted server for reuse")
+	flag.DurationVar(&cfg.upstreamIdleTimeout, "upstream-idle-timeout", defaultUpstreamIdleTimeout, "how long idle connections to intercepted servers are kept open")
+	flag.DurationVar(&cfg.timeouts.dial, "dial-timeout", defaultDialTimeout, "how long connecting to a target server or upstream proxy may take")
+	flag.DurationVar(&cfg.timeouts.tlsHandshake, "tls-handshake-timeout", defaultTLSHandshakeTimeout, "how long TLS handshakes with clients and target servers may take")
+	flag.DurationVar(&cfg.timeouts.responseHeader, "response-header-timeout", defaultResponseHeaderTimeout, "how long to wait for a target server's response headers")
+	flag.DurationVar(&cfg.timeouts.idle, "idle-timeout", defaultClientIdleTimeout, "how long client connections may wait between requests, and tunnels may go without traffic")
+	flag.DurationVar(&cfg.timeouts.transaction, "transaction-timeout", 0, "how long a whole request and response may take (0 for no limit)")
+	flag.StringVar(&cfg.forwardingHeaders, "forwarding-headers", "", "comma separated headers revealing the proxy to add to forwarded requests: via, x-forwarded-for, forwarded (default none)")
+	flag.IntVar(&cfg.maxSessions, "max-sessions", defaultMaxSessions, "transactions kept in memory for inspection, oldest evicted first (0 to keep none)")
+	flag.Int64Var(&cfg.maxSessionBytes, "max-session-bytes", defaultMaxSessionBytes, "bytes of headers and bodies kept in memory for inspection, oldest transactions evicted first")
+	flag.IntVar(&cfg.sessionBodyLimit, "session-body-limit", defaultSessionBodyLimit, "bytes of each body kept in memory for inspection; the rest is only counted")
+	flag.StringVar(&cfg.harPath, "har", "", "HAR file to write transactions to as they finish, replacing any file there")
+	flag.StringVar(&cfg.importHARPath, "import-har", "", "HAR file whose transactions are loaded into the session store at startup")
+	flag.StringVar(&cfg.sazPath, "saz", "", "Fiddler SAZ archive to write the transactions kept to on shutdown, replacing any file there")
+	flag.StringVar(&cfg.importSAZPath, "import-saz", "", "Fiddler SAZ archive whose sessions are loaded into the session store at startup")
+	uiAddr := flag.String("ui-addr", defaultUIAddr, "address of the web UI for browsing the transactions kept (empty to disable)")
+	socksPort := flag.Int("socks-port", 0, "the port on which to also accept SOCKS5 and SOCKS4a clients (0 to disable)")
+	flag.StringVar(&cfg.socksAuth, "socks-auth", "", "user:password required from SOCKS5 clients")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "how long to let open connections finish when shutting down")
+	noProxy := flag.String("no-proxy", "localhost,127.0.0.1,::1", "NO_PROXY value for commands run with exec")
 	flag.Parse()
 
+	// `netmiddler exec -- <command>` intercepts a single command without changing the system
+	if flag.Arg(0) == "exec" {
+		os.Exit(runExec(cfg, flag.Args()[1:], *noProxy))
+	}
+
+	// Heal the machine before anything else if a previous run died without cleaning up
+	if err := restoreProxyState(restore); err != nil {
+		fmt.Printf("Error restoring proxy settings: %v\n", err)
+		return
+	}
+	if restore {
+		return
+	}
+
 	// Ensure the CA certificate exists for HTTPS MITM self-signing
 	if err := ensureCACert(uninstall); err != nil {
 		fmt.Printf("Error handling certificates: %v\n", err)
@@ -37,176 +97,430 @@ func main() {
 		return
 	}
 
+	scope, err := parseScope(*scopeUID, *scopeGID, *scopeCgroup, *scopeUnit)
+	if err != nil {
+		fmt.Printf("Error parsing interception scope: %v\n", err)
+		return
+	}
+
+	// Load the CA used to sign per-host certificates (assumed that the CA is already installed)
+	ca, err := loadCA(caCertFile, caKeyFile)
+	if err != nil {
+		fmt.Printf("Failed to load certificate: %v\n", err)
+		return
+	}
+	cfg.port = *port
+	proxy, err := newProxy(ca, cfg)
+	if err != nil {
+		fmt.Printf("Failed to configure proxy: %v\n", err)
+		return
+	}
+	proxy.markSockets = true
+	proxy.socksPort = *socksPort
+
+	// Listen before anything is redirected to us. The HTTP proxy also accepts
+	// connections redirected by the firewall rules.
+	httpAddr := ":" + strconv.Itoa(*port)
+	log.Printf("Starting HTTP proxy on %s\n", httpAddr)
+	ln, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		fmt.Printf("Failed to start HTTP proxy: %v\n", err)
+		return
+	}
+	listeners := []net.Listener{newTransparentListener(ln, proxy)}
+	if *socksPort != 0 {
+		socksAddr := ":" + strconv.Itoa(*socksPort)
+		log.Printf("Starting SOCKS proxy on %s\n", socksAddr)
+		socksLn, err := net.Listen("tcp", socksAddr)
+		if err != nil {
+			ln.Close()
+			fmt.Printf("Failed to start SOCKS proxy: %v\n", err)
+			return
+		}
+		listeners = append(listeners, newSOCKSListener(socksLn, proxy))
+	}
+
+	// Record the current settings before touching them, so a crash can be undone
+	if err := saveProxyState(*port); err != nil {
+		fmt.Printf("Error saving proxy state: %v\n", err)
+		return
+	}
+
+	// Clean up the proxy on exit or panic, or earlier during shutdown
+	cleanup := sync.OnceFunc(cleanupProxy)
+	defer cleanup()
+
 	// Enable proxy at the given port
-	enableProxy(*port)
+	log.Printf("Intercepting %s\n", scope)
+	if err := enableProxy(*port, scope); err != nil {
+		fmt.Printf("Error enabling proxy: %v\n", err)
+		return
+	}
 
 	// Set up signal capturing for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	// Clean up the proxy on exit or panic
-	defer func() {
-		fmt.Println("Cleaning up proxy on exit")
-		disableProxy()
-	}()
-
-	// Start proxy in a separate goroutine
-	go func() {
-		// Load the certificate (assumed that the CA is already installed)
-		cert, err := tls.LoadX509KeyPair("netmiddler.pem", "netmiddler_pk.pem")
-		if err != nil {
-			log.Fatalf("Failed to load certificate: %v", err)
-		}
-
-		proxy := &Proxy{cert: cert}
-
-		// Start HTTP proxy
-		httpAddr := ":" + strconv.Itoa(*port)
-		log.Printf("Starting HTTP proxy on %s\n", httpAddr)
-		if err := http.ListenAndServe(httpAddr, proxy); err != nil {
-			log.Fatalf("Failed to start HTTP proxy: %v", err)
+	servers := make([]*http.Server, len(listeners))
+	serveErr := make(chan error, len(listeners))
+	for i, l := range listeners {
+		servers[i] = proxy.newServer()
+		go func(server *http.Server, l net.Listener) {
+			serveErr <- server.Serve(l)
+		}(servers[i], l)
+	}
+	if *uiAddr != "" {
+		if proxy.sessions == nil {
+			log.Printf("Not serving the web UI: no sessions are kept (-max-sessions 0)\n")
+		} else if ui, err := proxy.startUI(*uiAddr); err != nil {
+			log.Printf("Error starting the web UI: %v\n", err)
+		} else {
+			servers = append(servers, ui)
 		}
-	}()
+	}
 
 	// Wait for an interrupt (e.g., ^C) signal
-	sig := <-sigChan
-	fmt.Printf("\nReceived signal: %v, shutting down...\n", sig)
+	select {
+	case sig := <-sigChan:
+		fmt.Printf("\nReceived signal: %v, shutting down (repeat to exit immediately)...\n", sig)
+	case err := <-serveErr:
+		fmt.Printf("Proxy stopped: %v\n", err)
+	}
 
-	// Exiting the main function will trigger the deferred `disableProxy`
+	// Stop redirecting clients to us first, so nothing new arrives while draining
+	cleanup()
+	go func() {
+		sig := <-sigChan
+		fmt.Printf("Received signal: %v, exiting immediately\n", sig)
+		proxy.conns.CloseAll()
+		os.Exit(1)
+	}()
+	proxy.shutdown(servers, *drainTimeout)
 }
 
 // Proxy structure to hold configuration
 type Proxy struct {
-	cert tls.Certificate
+	ca        *CertAuthority
+	port      int
+	transport *http.Transport
+	pool      *upstreamPool // forwards intercepted HTTPS requests
+	timeouts  timeouts
+
+	// forwarding selects the headers added to forwarded requests
+	forwarding forwardingHeaders
+
+	// sessions records the transactions relayed, nil when none are kept
+	sessions *sessionStore
+	// har receives each finished session when -har is set
+	har *harFile
+	// sazPath is where the sessions kept are written on shutdown, when set
+	sazPath string
+
+	untrustedCA   *CertAuthority
+	upstreamRoots *x509.CertPool
+	insecureHosts hostList
+	verifyFailure string
+	policy        *tlsPolicy
+
+	parentProxy  *url.URL
+	parentBypass hostList
+
+	socksPort     int
+	socksUser     string
+	socksPassword string
+
+	// conns tracks connections handled outside the http.Servers, for shutdown
+	conns connTracker
+
+	// markSockets is set when firewall rules redirect traffic to the proxy
+	markSockets bool
 }
 
 // Implement ServeHTTP to make Proxy implement http.Handler
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Handle HTTPS connections
+	// Requests addressed to the proxy itself rather than through it. Anything the
+	// proxy reports about itself is served by the UI, which only listens on loopback.
+	if _, redirected := r.Context().Value(originalDstKey{}).(string); !redirected && r.Method != http.MethodConnect && !r.URL.IsAbs() {
+		http.NotFound(w, r)
+		return
+	}
+	// Tunnels are intercepted; anything else is a plain HTTP request to forward
 	if r.Method == http.MethodConnect {
 		p.handleHTTPS(w, r)
 	} else {
-		// Handle HTTP requests here if needed
-		// You can implement similar MITM handling for HTTP requests if desired
 		p.handleHTTP(w, r)
 	}
 }
 
 // Handle HTTP traffic by forwarding it to the target host
 func (p *Proxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	transport := http.DefaultTransport
-	outReq := new(http.Request)
-	*outReq = *r
+	// Requests redirected by the firewall rules arrive in origin-form
+	if dst, ok := r.Context().Value(originalDstKey{}).(string); ok && !r.URL.IsAbs() {
+		r.URL.Scheme = "http"
+		r.URL.Host = r.Host
+		if r.URL.Host == "" {
+			r.URL.Host = dst
+		}
+	}
+
+	// An upgraded connection outlives the transaction, and has the idle timeout instead
+	limit := p.timeouts.transaction
+	if isUpgradeRequest(r) {
+		limit = 0
+	}
+	ctx, cancel := withTimeout(r.Context(), limit)
+	defer cancel()
+
+	rec := p.sessions.begin(r, "http")
+	var err error
+	defer func() { rec.finish(err) }()
+	ctx = rec.trace(ctx)
+	ctx, progress := traceProgress(ctx)
+
+	// Interim responses, such as 100 Continue for a client waiting to send its body, are relayed as they arrive
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			return writeInterimHeader(w, code, header)
+		},
+	})
+
+	outReq := r.WithContext(ctx)
 	outReq.RequestURI = ""
-	resp, err := transport.RoundTrip(outReq)
+	p.prepareRequest(outReq, r, "http")
+	rec.captureRequest(outReq)
+	reqLog := teeRequestBody(outReq, "HTTP Request Body")
+	start := time.Now()
+	resp, err := p.transport.RoundTrip(outReq)
+	reqLog.Close()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		err = p.timeouts.roundTripError(ctx, progress, err)
+		log.Printf("HTTP %s %s failed: %v\n", r.Method, r.URL, err)
+		http.Error(w, err.Error(), upstreamErrorStatus(err))
 		return
 	}
 	defer resp.Body.Close()
 
-	// Log the HTTP request
-	log.Printf("HTTP %s %s %s", r.Method, r.URL, resp.Status)
+	// Log the HTTP transaction
+	logTransaction("HTTP", r, resp, time.Since(start))
+	rec.response(resp)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		err = p.handleUpgrade(w, r, resp, rec)
+		return
+	}
 
-	// Copy headers
+	// Copy headers, announcing the trailers which follow the body
+	p.prepareResponse(resp)
 	for key, value := range resp.Header {
 		w.Header()[key] = value
 	}
+	for key := range resp.Trailer {
+		w.Header().Add("Trailer", key)
+	}
 	w.WriteHeader(resp.StatusCode)
 
 	// Log the body if printBody is true
 	var bodyReader io.Reader = resp.Body
 	if printBody {
-		bodyReader = io.TeeReader(resp.Body, logWriter("HTTP Body: "))
+		bodyLog := bodyLogWriter("HTTP Response Body", resp.Header)
+		defer bodyLog.Close()
+		bodyReader = io.TeeReader(resp.Body, bodyLog)
+	}
+
+	if _, err = io.Copy(w, bodyReader); err != nil {
+		err = p.timeouts.bodyError(ctx, err)
+		log.Printf("HTTP %s %s failed: %v\n", r.Method, r.URL, err)
+		return
 	}
 
-	io.Copy(w, bodyReader)
+	// Trailers are only known once the body has been read
+	for key, value := range resp.Trailer {
+		w.Header()[key] = value
+	}
+}
+
+// handleUpgrade hands the client's connection over to the protocol the target
+// server switched to, relaying it until the server closes. It returns the error
+// which ended the relay, if any.
+func (p *Proxy) handleUpgrade(w http.ResponseWriter, r *http.Request, resp *http.Response, rec *recording) error {
+	// The transport returns the switched connection as the body
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(w, "Upgraded connection is not writable", http.StatusBadGateway)
+		return errors.New("upgraded connection is not writable")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Cannot hijack connection", http.StatusInternalServerError)
+		return errors.New("cannot hijack connection")
+	}
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return err
+	}
+	defer clientConn.Close()
+	defer p.conns.Track(clientConn)()
+
+	if err := writeInterimResponse(clientConn, resp.StatusCode, resp.Header); err != nil {
+		return err
+	}
+	return relayUpgraded(r.URL.String(), resp, clientConn, clientBuf.Reader, upstream, upstream, p.timeouts.idle, rec)
 }
 
 // Handle HTTPS connections with MITM attack
 func (p *Proxy) handleHTTPS(w http.ResponseWriter, r *http.Request) {
+	// Connect to the target server before accepting the tunnel, so a failure can
+	// still be reported to the client as an HTTP error
+	target, err := p.connectTarget(r.Host, r.Host)
+	if err != nil {
+		log.Printf("Failed to connect to target server %s: %v\n", r.Host, err)
+		http.Error(w, err.Error(), upstreamErrorStatus(err))
+		return
+	}
+	defer target.Close()
+
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Cannot hijack connection", http.StatusInternalServerError)
 		return
 	}
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, clientBuf, err := hijacker.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 	defer clientConn.Close()
+	defer p.conns.Track(clientConn)()
+
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		log.Printf("Failed to accept CONNECT tunnel to %s: %v\n", r.Host, err)
+		return
+	}
+	// The client may have sent its ClientHello straight after the CONNECT request
+	p.interceptTLS(&peekedConn{Conn: clientConn, reader: clientBuf.Reader}, target, r.Host)
+}
+
+// dialTarget connects to the target server host at addr, through the parent proxy
+// when one applies
+func (p *Proxy) dialTarget(host, addr string) (net.Conn, error) {
+	if parent := p.parentFor(host, addr); parent != nil {
+		log.Printf("Dialing target server %s via upstream proxy %s\n", host, parent.Redacted())
+	} else {
+		log.Printf("Dialing target server %s\n", addr)
+	}
+	return p.dialUpstream(context.Background(), host, addr)
+}
 
-	// Load the certificate (MITM certificate)
-	cert, err := tls.LoadX509KeyPair("netmiddler.pem", "netmiddler_pk.pem")
+// interceptTLS terminates the client's TLS using a certificate minted for host and
+// forwards the decrypted transactions to the target through the upstream pool. The
+// target is verified first, so the certificate presented to the client can reflect
+// whether the real one is trustworthy.
+func (p *Proxy) interceptTLS(clientConn net.Conn, target *upstreamTarget, host string) {
+	// Peek at the protocols the client offers
+	clientConn.SetDeadline(deadline(p.timeouts.tlsHandshake))
+	hello, replay, err := peekClientHello(clientConn)
 	if err != nil {
-		log.Fatalf("Failed to load certificate: %v", err)
+		log.Printf("Failed to read TLS ClientHello for host %s: %v\n", host, asTimeout(err, phaseClientHandshake, p.timeouts.tlsHandshake))
+		return
+	}
+	clientConn = &peekedConn{Conn: clientConn, reader: replay}
+
+	// CIDR patterns are matched against the server's address, when we know it
+	ip := net.ParseIP(hostOnly(target.addr))
+	if target.info != nil && target.info.ip != nil {
+		ip = target.info.ip
+	} else if target.conn != nil && p.parentFor(target.host, target.addr) == nil {
+		if tcpAddr, ok := target.conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = tcpAddr.IP
+		}
+	}
+	if pass, reason := p.policy.Passthrough(host, ip); pass {
+		// A verified target may not have been dialed yet
+		if target.conn == nil {
+			if target.conn, err = p.dialTarget(target.host, target.addr); err != nil {
+				log.Printf("Failed to connect to target server %s: %v\n", target.addr, err)
+				return
+			}
+		}
+		clientConn.SetDeadline(time.Time{})
+		passThrough(clientConn, target.conn, host, reason, p.timeouts.idle)
+		return
 	}
 
-	// Establish a TLS connection with the client
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ServerName:   r.Host, // Use the requested host as the server name
+	if target.info == nil {
+		if err := p.pool.verify(context.Background(), target); err != nil {
+			log.Printf("%v\n", err)
+			return
+		}
 	}
 
-	log.Printf("Starting TLS handshake with client for host %s\n", r.Host)
+	ca := p.ca
+	verifyErr := target.info.verifyErr
+	if verifyErr != nil {
+		log.Printf("Certificate of target server %s failed verification: %v\n", host, verifyErr)
+		if p.verifyFailure == verifyFailureUntrusted {
+			ca = p.untrustedCA
+		}
+	}
+
+	// Establish a TLS connection with the client, presenting a leaf certificate
+	// minted for the SNI name (or the requested host when the client sends none)
+	tlsConfig := ca.TLSConfig(host)
+	tlsConfig.NextProtos = clientProtos(hello.SupportedProtos)
+	if verifyErr != nil && p.verifyFailure == verifyFailureError {
+		// The error page is served over HTTP/1.1
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+	certPresented := watchCertificate(tlsConfig)
+
+	log.Printf("Starting TLS handshake with client for host %s\n", host)
 
+	// Verifying the target may have used up some of the time, so start afresh
+	clientConn.SetDeadline(deadline(p.timeouts.tlsHandshake))
 	tlsClientConn := tls.Server(clientConn, tlsConfig)
 	if err := tlsClientConn.Handshake(); err != nil {
+		err = asTimeout(err, phaseClientHandshake, p.timeouts.tlsHandshake)
 		log.Printf("TLS handshake with client failed: %v\n", err)
+		if ca == p.ca && certPresented() {
+			p.policy.ClientHandshakeFailed(host, err)
+		}
 		return
 	}
-	log.Printf("TLS handshake with client succeeded for host %s\n", r.Host)
+	log.Printf("TLS handshake with client succeeded for host %s\n", host)
+	clientConn.SetDeadline(time.Time{})
 
 	defer tlsClientConn.Close()
 
-	// Dial the target server
-	log.Printf("Dialing target server %s\n", r.Host)
-	targetConn, err := net.Dial("tcp", r.Host)
-	if err != nil {
-		log.Printf("Failed to connect to target server: %v\n", err)
+	if verifyErr != nil && p.verifyFailure == verifyFailureError {
+		tlsClientConn.SetReadDeadline(deadline(p.timeouts.idle))
+		serveVerifyError(tlsClientConn, host, verifyErr)
 		return
 	}
-	defer targetConn.Close()
 
-	// Establish a TLS connection with the target server
-	tlsTargetConn := tls.Client(targetConn, &tls.Config{
-		InsecureSkipVerify: true,                          // Skip verifying the server's certificate for simplicity
-		ServerName:         strings.Split(r.Host, ":")[0], // Extract the hostname
-	})
-	if err := tlsTargetConn.Handshake(); err != nil {
-		log.Printf("TLS handshake with target server failed: %v\n", err)
-		return
-	}
-	log.Printf("TLS handshake with target server succeeded for host %s\n", r.Host)
-
-	defer tlsTargetConn.Close()
-
-	// Log the HTTPS request
-	log.Printf("HTTPS %s %s", r.Method, r.URL)
-
-	// Tunnel data between client and target server
-	go func() {
-		io.Copy(tlsTargetConn, tlsClientConn)
-	}()
-
-	var bodyReader io.Reader = tlsTargetConn
-	if printBody {
-		bodyReader = io.TeeReader(tlsTargetConn, logWriter("HTTPS Body: "))
+	// Forward the decrypted HTTP transactions to the target server
+	ctx := context.WithValue(context.Background(), upstreamTargetKey{}, target)
+	clientProto := tlsClientConn.ConnectionState().NegotiatedProtocol
+	log.Printf("Intercepting %s with client protocol %q\n", host, clientProto)
+	if clientProto == "h2" {
+		p.serveH2(ctx, tlsClientConn, host)
+	} else {
+		p.serveMITM(ctx, tlsClientConn, host)
 	}
-
-	io.Copy(tlsClientConn, bodyReader)
 }
 
-func logWriter(prefix string) io.Writer {
-	return &logWriterStruct{prefix: prefix}
-}
-
-type logWriterStruct struct {
-	prefix string
+// logTransaction logs a request and the response headers received for it
+func logTransaction(scheme string, req *http.Request, resp *http.Response, elapsed time.Duration) {
+	log.Printf("%s %s %s %s (%v)", scheme, req.Method, req.URL, resp.Status, elapsed.Round(time.Millisecond))
+	if printHeaders {
+		log.Printf("%s Request Headers:\n%s", scheme, formatHeaders(req.Header))
+		log.Printf("%s Response Headers:\n%s", scheme, formatHeaders(resp.Header))
+	}
 }
 
-func (w *logWriterStruct) Write(p []byte) (n int, err error) {
-	log.Printf("%s%s", w.prefix, string(p))
-	return len(p), nil
+// formatHeaders renders headers in wire format, sorted by key
+func formatHeaders(h http.Header) string {
+	var b strings.Builder
+	h.Write(&b)
+	return b.String()
 }
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// defaultPrintBodyLimit is the default of -print-body-limit
+const defaultPrintBodyLimit = 64 << 10
+
+// bodyLog collects a body as it is relayed and logs it, decoded and rendered for
+// its content type, once closed. Only the first limit bytes are kept.
+type bodyLog struct {
+	prefix string
+	header http.Header
+	limit  int
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	total  int64
+	closed bool
+}
+
+// teeRequestBody logs the body of req as the transport sends it, when -print-body
+// is set. The returned log is closed once the transport is done with the request.
+func teeRequestBody(req *http.Request, prefix string) io.Closer {
+	if !printBody || req.Body == nil || req.Body == http.NoBody {
+		return io.NopCloser(nil)
+	}
+	bodyLog := bodyLogWriter(prefix, req.Header)
+	req.Body = readCloser{io.TeeReader(req.Body, bodyLog), req.Body}
+	return bodyLog
+}
+
+// bodyLogWriter returns a bodyLog for a body with the given headers. It must be
+// closed once the body is done; anything written after that is ignored.
+func bodyLogWriter(prefix string, header http.Header) io.WriteCloser {
+	return &bodyLog{prefix: prefix, header: header.Clone(), limit: printBodyLimit}
+}
+
+func (b *bodyLog) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return len(p), nil
+	}
+	b.total += int64(len(p))
+	if room := b.limit - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+func (b *bodyLog) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || b.total == 0 {
+		b.closed = true
+		return nil
+	}
+	b.closed = true
+
+	contentType := b.header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "no content type"
+	}
+	log.Printf("%s (%s, %d bytes):\n%s\n", b.prefix, contentType, b.total, b.render())
+	return nil
+}
+
+// render decodes and renders the body kept, marking where it was cut short
+func (b *bodyLog) render() string {
+	return renderCaptured(b.buf.Bytes(), b.total, b.header, b.limit)
+}
+
+// renderCaptured decodes and renders data, the first bytes of a total byte body
+// with the given headers, keeping at most limit decoded bytes. Notes say where
+// the body was cut short.
+func renderCaptured(data []byte, total int64, header http.Header, limit int) string {
+	captured := int64(len(data))
+	var notes []string
+
+	if codings := contentCodings(header); len(codings) > 0 {
+		decoded, truncated, err := decodeLimited(data, codings, limit)
+		// A body cut short can't be decoded to the end, but what was decoded is worth showing
+		if err != nil && (captured == total || len(decoded) == 0) {
+			notes = append(notes, err.Error())
+		} else {
+			data = decoded
+			if truncated {
+				notes = append(notes, fmt.Sprintf("[truncated: printed the first %d bytes after decoding]", limit))
+			}
+		}
+	}
+	if captured < total {
+		notes = append(notes, fmt.Sprintf("[truncated: printed the first %d of %d bytes]", captured, total))
+	}
+
+	out := renderBody(data, header.Get("Content-Type"))
+	for _, note := range notes {
+		out += "\n" + note
+	}
+	return out
+}
+
+// decodeLimited undoes codings on data, keeping at most limit decoded bytes
+func decodeLimited(data []byte, codings []string, limit int) ([]byte, bool, error) {
+	r, err := decodeBody(bytes.NewReader(data), codings)
+	if err != nil {
+		return nil, false, err
+	}
+	decoded, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return decoded, false, fmt.Errorf("failed to decode %s body: %w", strings.Join(codings, ", "), err)
+	}
+	if len(decoded) > limit {
+		return decoded[:limit], true, nil
+	}
+	return decoded, false, nil
+}
+
+// renderBody renders a body for the log according to its Content-Type: JSON
+// indented, XML and HTML formatted, forms decoded field by field, text converted
+// from its charset, and anything else as a hexdump
+func renderBody(data []byte, contentType string) string {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+
+	var out string
+	var err error
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		out, err = renderJSON(data)
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		out, err = renderHTML(data)
+	case strings.HasSuffix(mediaType, "/xml") || strings.HasSuffix(mediaType, "+xml"):
+		out, err = renderXML(data)
+	case mediaType == "application/x-www-form-urlencoded":
+		out, err = renderForm(data)
+	case strings.HasPrefix(mediaType, "multipart/"):
+		out, err = renderMultipart(data, params["boundary"])
+	case mediaType == "" && json.Valid(data):
+		out, err = renderJSON(data)
+	default:
+		err = errors.New("no structure")
+	}
+	if err == nil {
+		return out
+	}
+	// Anything malformed or cut short is shown as plain text instead
+	return renderText(data, params["charset"])
+}
+
+func renderJSON(data []byte) (string, error) {
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func renderXML(data []byte) (string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	dec.CharsetReader = charset.NewReaderLabel
+	var out bytes.Buffer
+	enc := xml.NewEncoder(&out)
+	enc.Indent("", "  ")
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		// Whitespace between elements is replaced by the indentation
+		if text, ok := tok.(xml.CharData); ok {
+			if text = bytes.TrimSpace(text); len(text) == 0 {
+				continue
+			}
+			tok = text
+		}
+		if err := enc.EncodeToken(xml.CopyToken(tok)); err != nil {
+			return "", err
+		}
+		// The encoder only breaks lines before elements
+		switch tok.(type) {
+		case xml.ProcInst, xml.Directive:
+			enc.Flush()
+			out.WriteByte('\n')
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// htmlVoidElements have no end tag, so don't open a level of indentation
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+func renderHTML(data []byte) (string, error) {
+	z := html.NewTokenizer(bytes.NewReader(data))
+	var out strings.Builder
+	depth := 0
+	line := func(s string) {
+		if s = strings.TrimSpace(s); s != "" {
+			out.WriteString(strings.Repeat("  ", depth))
+			out.WriteString(s)
+			out.WriteByte('\n')
+		}
+	}
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return "", z.Err()
+			}
+			return strings.TrimSuffix(out.String(), "\n"), nil
+		case html.StartTagToken:
+			tok := z.Token()
+			line(tok.String())
+			if !htmlVoidElements[tok.Data] {
+				depth++
+			}
+		case html.EndTagToken:
+			if depth > 0 {
+				depth--
+			}
+			line(string(z.Raw()))
+		default:
+			line(string(z.Raw()))
+		}
+	}
+}
+
+// renderForm lists the fields of a URL-encoded form in their original order
+func renderForm(data []byte) (string, error) {
+	var lines []string
+	for _, field := range strings.Split(string(data), "&") {
+		if field == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(field, "=")
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			return "", err
+		}
+		if value, err = url.QueryUnescape(value); err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", key, value))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// renderMultipart lists the parts of a multipart body, summarizing file uploads
+// and other binary parts rather than printing them
+func renderMultipart(data []byte, boundary string) (string, error) {
+	if boundary == "" {
+		return "", errors.New("multipart body without boundary")
+	}
+	mr := multipart.NewReader(bytes.NewReader(data), boundary)
+	var lines []string
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if len(lines) == 0 {
+				return "", err
+			}
+			lines = append(lines, fmt.Sprintf("[parts missing: %v]", err))
+			break
+		}
+		body, err := io.ReadAll(part)
+		partType := part.Header.Get("Content-Type")
+
+		name := part.FormName()
+		if name == "" {
+			name = "part"
+		}
+		switch {
+		case part.FileName() != "" || !isTextual(partType, body):
+			if partType == "" {
+				partType = http.DetectContentType(body)
+			}
+			lines = append(lines, fmt.Sprintf("%s: [file %q, %s, %d bytes]", name, part.FileName(), partType, len(body)))
+		default:
+			lines = append(lines, fmt.Sprintf("%s: %s", name, renderBody(body, partType)))
+		}
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("[parts missing: %v]", err))
+			break
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// renderText converts text from its charset to UTF-8, falling back to a hexdump
+// for anything which isn't text
+func renderText(data []byte, charsetLabel string) string {
+	if charsetLabel != "" && !strings.EqualFold(charsetLabel, "utf-8") {
+		if r, err := charset.NewReaderLabel(charsetLabel, bytes.NewReader(data)); err == nil {
+			if converted, err := io.ReadAll(r); err == nil {
+				data = converted
+			}
+		}
+	}
+	if !isPrintable(data) {
+		return strings.TrimSuffix(hex.Dump(data), "\n")
+	}
+	return string(data)
+}
+
+// isTextual reports whether a part with the given Content-Type, which may be
+// empty, holds text
+func isTextual(contentType string, data []byte) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "":
+		return isPrintable(data)
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "application/json", mediaType == "application/xml",
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	return false
+}
+
+// isPrintable reports whether data is UTF-8 text without control characters
+// other than whitespace. A character cut short at the end is tolerated.
+func isPrintable(data []byte) bool {
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size <= 1 {
+			return len(data) < utf8.UTFMax && !utf8.FullRune(data)
+		}
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return false
+		}
+		data = data[size:]
+	}
+	return true
+}
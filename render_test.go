@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRenderBody(t *testing.T) {
+	multipartBody := "--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"title\"\r\n\r\n" +
+		"Holiday\r\n" +
+		"--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"photo\"; filename=\"beach.png\"\r\n" +
+		"Content-Type: image/png\r\n\r\n" +
+		"\x89PNG\r\n\x1a\n\x00\x00\r\n" +
+		"--xyz--\r\n"
+
+	tests := []struct {
+		name        string
+		contentType string
+		data        string
+		want        string
+	}{
+		{"JSON", "application/json", `{"a":[1,2]}`, "{\n  \"a\": [\n    1,\n    2\n  ]\n}"},
+		{"JSON suffix", "application/problem+json; charset=utf-8", `{"a":1}`, "{\n  \"a\": 1\n}"},
+		{"JSON without content type", "", `[true]`, "[\n  true\n]"},
+		{"malformed JSON", "application/json", `{"a":`, `{"a":`},
+		{"XML", "application/xml", `<?xml version="1.0"?><a> <b>x</b></a>`, "<?xml version=\"1.0\"?>\n<a>\n  <b>x</b>\n</a>"},
+		{"HTML", "text/html", "<html><body><p>Hi<br>there</p></body></html>",
+			"<html>\n  <body>\n    <p>\n      Hi\n      <br>\n      there\n    </p>\n  </body>\n</html>"},
+		{"form", "application/x-www-form-urlencoded", "name=J%C3%B6rg+S&empty=&flag", "name: Jörg S\nempty: \nflag: "},
+		{"multipart", "multipart/form-data; boundary=xyz", multipartBody,
+			"title: Holiday\nphoto: [file \"beach.png\", image/png, 10 bytes]"},
+		{"charset", "text/plain; charset=iso-8859-1", "caf\xe9", "café"},
+		{"plain text", "text/plain", "hello", "hello"},
+		{"binary", "application/octet-stream", "\x00\x01AB",
+			"00000000  00 01 41 42                                       |..AB|"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderBody([]byte(tt.data), tt.contentType); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderCaptured(t *testing.T) {
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	gzipHeader := http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}}
+	text := strings.Repeat("a", 100)
+	compressed := gzipped([]byte(text))
+
+	tests := []struct {
+		name   string
+		data   []byte
+		total  int64
+		header http.Header
+		limit  int
+		want   string
+	}{
+		{"whole body", []byte(`{"a":1}`), 7, jsonHeader, 100, "{\n  \"a\": 1\n}"},
+		// A cut short body can't be parsed, so is shown as text
+		{"truncated", []byte(`{"a":`), 7, jsonHeader, 5, `{"a":` + "\n[truncated: printed the first 5 of 7 bytes]"},
+		{"decoded", compressed, int64(len(compressed)), gzipHeader, 100, text},
+		{"truncated before decoding", compressed[:len(compressed)-8], int64(len(compressed)), gzipHeader, 100,
+			text + "\n[truncated: printed the first " + strconv.Itoa(len(compressed)-8) + " of " + strconv.Itoa(len(compressed)) + " bytes]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderCaptured(tt.data, tt.total, tt.header, tt.limit); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
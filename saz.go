@@ -0,0 +1,627 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fiddler's SAZ archives are zip files holding, for each session numbered N, the
+// raw request in raw/N_c.txt, the raw response in raw/N_s.txt, metadata in
+// raw/N_m.xml and any WebSocket messages in raw/N_w.txt. Details NetMiddler records
+// which Fiddler has no place for are kept as x-netmiddler-* session flags.
+
+// Session flags written to and read from _m.xml
+const (
+	sazFlagClientIP     = "x-clientip"
+	sazFlagClientPort   = "x-clientport"
+	sazFlagConnectHost  = "x-netmiddler-connect-host"
+	sazFlagError        = "x-netmiddler-error"
+	sazFlagTimeoutPhase = "x-netmiddler-timeout-phase"
+	sazFlagTLS          = "x-netmiddler-tls"
+	sazFlagNoResponse   = "x-netmiddler-no-response"
+	sazFlagRequestSize  = "x-netmiddler-request-size"
+	sazFlagResponseSize = "x-netmiddler-response-size"
+
+	// Fiddler only speaks HTTP/1.x, so other versions are kept as flags
+	sazFlagRequestProto  = "x-netmiddler-request-proto"
+	sazFlagResponseProto = "x-netmiddler-response-proto"
+)
+
+// maxSAZFile bounds each file read from a SAZ archive, so an archive can't
+// expand into more memory than a capture plausibly needs
+const maxSAZFile = 256 << 20
+
+var errSAZFileTooLarge = fmt.Errorf("file larger than %d bytes", maxSAZFile)
+
+// sazTimeFormat is the round-trip format .NET writes DateTimes in
+const sazTimeFormat = "2006-01-02T15:04:05.0000000-07:00"
+
+const sazContentTypes = `<?xml version="1.0" encoding="utf-8" ?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="htm" ContentType="text/html" />
+<Default Extension="xml" ContentType="application/xml" />
+<Default Extension="txt" ContentType="text/plain" />
+</Types>
+`
+
+type sazSession struct {
+	XMLName xml.Name      `xml:"Session"`
+	SID     uint64        `xml:"SID,attr"`
+	Flags   string        `xml:"BitFlags,attr"`
+	Timers  sazTimers     `xml:"SessionTimers"`
+	Pipe    sazPipeInfo   `xml:"PipeInfo"`
+	Entries []sazFlagItem `xml:"SessionFlags>SessionFlag"`
+}
+
+// sazTimers are the moments Fiddler records for a session. Those a session never
+// reached hold the zero DateTime.
+type sazTimers struct {
+	ClientConnected     string `xml:"ClientConnected,attr"`
+	ClientBeginRequest  string `xml:"ClientBeginRequest,attr"`
+	GotRequestHeaders   string `xml:"GotRequestHeaders,attr"`
+	ClientDoneRequest   string `xml:"ClientDoneRequest,attr"`
+	GatewayTime         string `xml:"GatewayTime,attr"`
+	DNSTime             string `xml:"DNSTime,attr"`
+	TCPConnectTime      string `xml:"TCPConnectTime,attr"`
+	HTTPSHandshakeTime  string `xml:"HTTPSHandshakeTime,attr"`
+	ServerConnected     string `xml:"ServerConnected,attr"`
+	FiddlerBeginRequest string `xml:"FiddlerBeginRequest,attr"`
+	ServerGotRequest    string `xml:"ServerGotRequest,attr"`
+	ServerBeginResponse string `xml:"ServerBeginResponse,attr"`
+	GotResponseHeaders  string `xml:"GotResponseHeaders,attr"`
+	ServerDoneResponse  string `xml:"ServerDoneResponse,attr"`
+	ClientBeginResponse string `xml:"ClientBeginResponse,attr"`
+	ClientDoneResponse  string `xml:"ClientDoneResponse,attr"`
+}
+
+type sazPipeInfo struct {
+	CltReuse bool `xml:"CltReuse,attr,omitempty"`
+	Reused   bool `xml:"Reused,attr,omitempty"`
+}
+
+type sazFlagItem struct {
+	Name  string `xml:"N,attr"`
+	Value string `xml:"V,attr"`
+}
+
+// writeSAZ writes sessions to w as a SAZ archive
+func writeSAZ(w io.Writer, sessions []Session) error {
+	zw := zip.NewWriter(w)
+	if err := writeZipFile(zw, "[Content_Types].xml", []byte(sazContentTypes)); err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, "_index.htm", sazIndex(sessions)); err != nil {
+		return err
+	}
+	width := len(strconv.Itoa(len(sessions)))
+	for i, s := range sessions {
+		prefix := fmt.Sprintf("raw/%0*d_", width, i+1)
+		if err := writeZipFile(zw, prefix+"c.txt", sazRequest(s)); err != nil {
+			return err
+		}
+		if err := writeZipFile(zw, prefix+"s.txt", sazResponse(s)); err != nil {
+			return err
+		}
+		meta, err := xml.MarshalIndent(sazMetadata(s, uint64(i+1)), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeZipFile(zw, prefix+"m.xml", append([]byte(xml.Header), meta...)); err != nil {
+			return err
+		}
+		if len(s.WebSocket) > 0 {
+			if err := writeZipFile(zw, prefix+"w.txt", sazWebSocket(s.WebSocket)); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// sazIndex lists the sessions the way Fiddler's _index.htm does, for browsing
+// the archive without Fiddler
+func sazIndex(sessions []Session) []byte {
+	var b bytes.Buffer
+	b.WriteString("<html><head><meta charset=\"utf-8\"><title>NetMiddler sessions</title></head><body>\n<table border=\"1\">\n")
+	b.WriteString("<tr><th>#</th><th>Result</th><th>Method</th><th>URL</th><th>Body</th></tr>\n")
+	width := len(strconv.Itoa(len(sessions)))
+	for i, s := range sessions {
+		prefix := fmt.Sprintf("raw/%0*d_", width, i+1)
+		fmt.Fprintf(&b, "<tr><td><a href=\"%sc.txt\">C</a> <a href=\"%ss.txt\">S</a> <a href=\"%sm.xml\">M</a></td><td>%d</td><td>%s</td><td>%s</td><td>%d</td></tr>\n",
+			prefix, prefix, prefix, s.StatusCode, html.EscapeString(s.Method), html.EscapeString(s.URL), s.ResponseBody.Size)
+	}
+	b.WriteString("</table></body></html>\n")
+	return b.Bytes()
+}
+
+// sazRequest renders the request as Fiddler stores it: the request line with the
+// absolute URL, the headers and the body as relayed
+func sazRequest(s Session) []byte {
+	var b bytes.Buffer
+	proto := s.RequestProto
+	if proto == "" || strings.HasPrefix(proto, "HTTP/2") {
+		// Fiddler only reads HTTP/1.x request lines
+		proto = "HTTP/1.1"
+	}
+	fmt.Fprintf(&b, "%s %s %s\r\n", s.Method, s.URL, proto)
+	header := s.RequestHeader.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	// Go keeps the Host header apart from the others
+	if header.Get("Host") == "" {
+		if u, err := url.Parse(s.URL); err == nil {
+			fmt.Fprintf(&b, "Host: %s\r\n", u.Host)
+		}
+	}
+	// A chunked request body is stored whole, so its length has to be given
+	if len(s.RequestBody.Data) > 0 && header.Get("Content-Length") == "" {
+		header.Set("Content-Length", strconv.FormatInt(s.RequestBody.Size, 10))
+	}
+	header.Write(&b)
+	b.WriteString("\r\n")
+	b.Write(s.RequestBody.Data)
+	return b.Bytes()
+}
+
+// sazResponse renders the response as Fiddler stores it. Fiddler has no sessions
+// without a response, so a failed transaction gets a 502 stating the error, as
+// Fiddler generates itself.
+func sazResponse(s Session) []byte {
+	var b bytes.Buffer
+	if s.StatusCode == 0 {
+		body := "NetMiddler failed to forward the request: " + s.Error
+		fmt.Fprintf(&b, "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		return b.Bytes()
+	}
+	proto := s.ResponseProto
+	if proto == "" || strings.HasPrefix(proto, "HTTP/2") {
+		proto = "HTTP/1.1"
+	}
+	status := s.Status
+	if status == "" {
+		status = fmt.Sprintf("%d %s", s.StatusCode, http.StatusText(s.StatusCode))
+	}
+	fmt.Fprintf(&b, "%s %s\r\n", proto, status)
+	s.ResponseHeader.Write(&b)
+	b.WriteString("\r\n")
+	b.Write(s.ResponseBody.Data)
+	return b.Bytes()
+}
+
+// sazMetadata describes s for _m.xml
+func sazMetadata(s Session, sid uint64) sazSession {
+	meta := sazSession{SID: sid, Flags: "0"}
+	t := s.Timings
+	requestDone := t.RequestSent
+	if requestDone.IsZero() {
+		requestDone = t.Start
+	}
+	meta.Timers = sazTimers{
+		ClientConnected:     sazTime(t.Start),
+		ClientBeginRequest:  sazTime(t.Start),
+		GotRequestHeaders:   sazTime(t.Start),
+		ClientDoneRequest:   sazTime(requestDone),
+		GatewayTime:         "0",
+		DNSTime:             "0",
+		TCPConnectTime:      "0",
+		HTTPSHandshakeTime:  "0",
+		ServerConnected:     sazTime(t.GotConn),
+		FiddlerBeginRequest: sazTime(t.GotConn),
+		ServerGotRequest:    sazTime(t.RequestSent),
+		ServerBeginResponse: sazTime(t.FirstByte),
+		GotResponseHeaders:  sazTime(t.FirstByte),
+		ServerDoneResponse:  sazTime(t.End),
+		ClientBeginResponse: sazTime(t.FirstByte),
+		ClientDoneResponse:  sazTime(t.End),
+	}
+
+	flag := func(name, value string) {
+		if value != "" {
+			meta.Entries = append(meta.Entries, sazFlagItem{Name: name, Value: value})
+		}
+	}
+	if host, port, err := net.SplitHostPort(s.ClientAddr); err == nil {
+		flag(sazFlagClientIP, host)
+		flag(sazFlagClientPort, port)
+	}
+	flag(sazFlagConnectHost, s.ConnectHost)
+	flag(sazFlagError, s.Error)
+	flag(sazFlagTimeoutPhase, s.TimeoutPhase)
+	if s.TLS != nil {
+		tlsInfo, _ := json.Marshal(s.TLS)
+		flag(sazFlagTLS, string(tlsInfo))
+	}
+	if s.StatusCode == 0 {
+		flag(sazFlagNoResponse, "true")
+	}
+	if !strings.HasPrefix(s.RequestProto, "HTTP/1.") {
+		flag(sazFlagRequestProto, s.RequestProto)
+	}
+	if !strings.HasPrefix(s.ResponseProto, "HTTP/1.") {
+		flag(sazFlagResponseProto, s.ResponseProto)
+	}
+	if s.RequestBody.Truncated() {
+		flag(sazFlagRequestSize, strconv.FormatInt(s.RequestBody.Size, 10))
+	}
+	if s.ResponseBody.Truncated() {
+		flag(sazFlagResponseSize, strconv.FormatInt(s.ResponseBody.Size, 10))
+	}
+	return meta
+}
+
+func sazTime(t time.Time) string {
+	if t.IsZero() {
+		return "0001-01-01T00:00:00"
+	}
+	return t.Format(sazTimeFormat)
+}
+
+// sazWebSocket renders messages as Fiddler stores them: a block of headers for
+// each, followed by the unmasked frame
+func sazWebSocket(messages []*WebSocketMessage) []byte {
+	var b bytes.Buffer
+	for i, msg := range messages {
+		from := "Client"
+		if msg.Direction == wsReceive {
+			from = "Server"
+		}
+		frame := encodeWSFrame(msg.Opcode, msg.Payload)
+		fmt.Fprintf(&b, "Request-From: %s\r\nID: %d\r\nBitFlags: 0\r\nDoneRead: %s\r\nBeginSend: %s\r\nDoneSend: %s\r\nData-Length: %d\r\n\r\n",
+			from, i+1, sazTime(msg.Time), sazTime(msg.Time), sazTime(msg.Time), len(frame))
+		b.Write(frame)
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
+
+// sazEntryName matches the files of a session in a SAZ archive
+var sazEntryName = regexp.MustCompile(`^raw/(\d+)_([cmsw])\.(txt|xml)$`)
+
+// readSAZ reads the sessions of a SAZ archive in the order they were numbered
+func readSAZ(r io.ReaderAt, size int64) ([]*Session, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAZ: %w", err)
+	}
+	files := make(map[int]map[string]*zip.File)
+	for _, f := range zr.File {
+		m := sazEntryName.FindStringSubmatch(strings.ReplaceAll(f.Name, `\`, "/"))
+		if m == nil {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		if files[n] == nil {
+			files[n] = make(map[string]*zip.File)
+		}
+		files[n][m[2]] = f
+	}
+
+	numbers := make([]int, 0, len(files))
+	for n := range files {
+		numbers = append(numbers, n)
+	}
+	slices.Sort(numbers)
+
+	sessions := make([]*Session, 0, len(numbers))
+	for _, n := range numbers {
+		s, err := sazToSession(files[n])
+		if err != nil {
+			return nil, fmt.Errorf("SAZ session %d: %w", n, err)
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+func sazToSession(files map[string]*zip.File) (*Session, error) {
+	if files["c"] == nil {
+		return nil, errors.New("no request")
+	}
+	s := &Session{Done: true}
+
+	flags := map[string]string{}
+	if f := files["m"]; f != nil {
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var meta sazSession
+		if err := xml.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("invalid metadata: %w", err)
+		}
+		for _, item := range meta.Entries {
+			flags[strings.ToLower(item.Name)] = item.Value
+		}
+		s.Timings = sazTimings(meta.Timers)
+	}
+	if ip := flags[sazFlagClientIP]; ip != "" {
+		s.ClientAddr = net.JoinHostPort(ip, flags[sazFlagClientPort])
+	}
+	s.ConnectHost = flags[sazFlagConnectHost]
+	s.Error = flags[sazFlagError]
+	s.TimeoutPhase = flags[sazFlagTimeoutPhase]
+	if tlsInfo := flags[sazFlagTLS]; tlsInfo != "" {
+		s.TLS = &SessionTLS{}
+		if err := json.Unmarshal([]byte(tlsInfo), s.TLS); err != nil {
+			return nil, fmt.Errorf("invalid %s flag: %w", sazFlagTLS, err)
+		}
+	}
+
+	data, err := readZipFile(files["c"])
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	s.Method = req.Method
+	s.RequestProto = req.Proto
+	s.RequestHeader = req.Header
+	if proto := flags[sazFlagRequestProto]; proto != "" {
+		s.RequestProto = proto
+	}
+	s.URL = req.URL.String()
+	if !req.URL.IsAbs() {
+		// Fiddler stores plain HTTP requests made to it directly in origin-form
+		s.URL = "http://" + req.Host + req.URL.RequestURI()
+	}
+	if req.Method == http.MethodConnect {
+		s.URL = req.Host
+	}
+	if u, err := url.Parse(s.URL); err == nil {
+		s.Scheme = u.Scheme
+	}
+	s.RequestBody = sazBody(req.Body, flags[sazFlagRequestSize])
+	s.RequestTrailer = req.Trailer
+
+	if f := files["s"]; f != nil && flags[sazFlagNoResponse] == "" {
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response: %w", err)
+		}
+		s.StatusCode = resp.StatusCode
+		s.Status = resp.Status
+		s.ResponseProto = resp.Proto
+		s.ResponseHeader = resp.Header
+		if proto := flags[sazFlagResponseProto]; proto != "" {
+			s.ResponseProto = proto
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			s.ResponseBody = sazBody(resp.Body, flags[sazFlagResponseSize])
+			s.ResponseTrailer = resp.Trailer
+		}
+	}
+
+	if f := files["w"]; f != nil {
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if s.WebSocket, err = sazWebSocketMessages(data); err != nil {
+			return nil, fmt.Errorf("invalid WebSocket messages: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// readZipFile reads f, refusing files larger than maxSAZFile. The size in the
+// archive's directory can't be trusted, so it is checked while reading too.
+func readZipFile(f *zip.File) ([]byte, error) {
+	if f.UncompressedSize64 > maxSAZFile {
+		return nil, fmt.Errorf("%s: %w", f.Name, errSAZFileTooLarge)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxSAZFile+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSAZFile {
+		return nil, fmt.Errorf("%s: %w", f.Name, errSAZFileTooLarge)
+	}
+	return data, nil
+}
+
+// sazBody reads a body stored in a SAZ, which may have been cut short. size is the
+// size of the whole body when only its start was stored.
+func sazBody(r io.Reader, size string) SessionBody {
+	data, _ := io.ReadAll(r)
+	body := SessionBody{Data: data, Size: int64(len(data))}
+	if n, err := strconv.ParseInt(size, 10, 64); err == nil && n > body.Size {
+		body.Size = n
+	}
+	return body
+}
+
+// parseSAZTime parses a .NET DateTime, which lacks the offset when written in
+// local time. The zero DateTime becomes the zero time.
+func parseSAZTime(v string) time.Time {
+	when, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		if when, err = time.ParseInLocation("2006-01-02T15:04:05.9999999", v, time.Local); err != nil {
+			return time.Time{}
+		}
+	}
+	if when.Year() <= 1 {
+		return time.Time{}
+	}
+	return when
+}
+
+func sazTimings(t sazTimers) SessionTimings {
+	parse := func(values ...string) time.Time {
+		for _, v := range values {
+			if when := parseSAZTime(v); !when.IsZero() {
+				return when
+			}
+		}
+		return time.Time{}
+	}
+	return SessionTimings{
+		Start:       parse(t.ClientBeginRequest, t.ClientConnected),
+		GotConn:     parse(t.ServerConnected, t.FiddlerBeginRequest),
+		RequestSent: parse(t.ServerGotRequest),
+		FirstByte:   parse(t.ServerBeginResponse, t.GotResponseHeaders),
+		End:         parse(t.ClientDoneResponse, t.ServerDoneResponse),
+	}
+}
+
+// sazWebSocketMessages parses the messages of a _w.txt file
+func sazWebSocketMessages(data []byte) ([]*WebSocketMessage, error) {
+	br := bytes.NewReader(data)
+	r := bufio.NewReader(br)
+	var messages []*WebSocketMessage
+	for {
+		// Messages are separated by line breaks
+		next, err := r.Peek(1)
+		if err != nil {
+			return messages, nil
+		}
+		if next[0] == '\r' || next[0] == '\n' {
+			r.Discard(1)
+			continue
+		}
+
+		header, err := textproto.NewReader(r).ReadMIMEHeader()
+		if err != nil {
+			return nil, err
+		}
+		// The length is checked against what is left before anything is allocated for it
+		length, err := strconv.Atoi(header.Get("Data-Length"))
+		if err != nil || length < 0 || length > r.Buffered()+br.Len() {
+			return nil, fmt.Errorf("invalid Data-Length %q", header.Get("Data-Length"))
+		}
+		raw := make([]byte, length)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, err
+		}
+		frame, err := readWSFrame(bufio.NewReader(bytes.NewReader(raw)))
+		if err != nil {
+			return nil, err
+		}
+		msg := &WebSocketMessage{
+			Direction: wsSend,
+			Opcode:    frame.opcode,
+			Payload:   frame.payload,
+			Truncated: frame.truncated,
+		}
+		if strings.EqualFold(header.Get("Request-From"), "Server") {
+			msg.Direction = wsReceive
+		}
+		msg.Time = parseSAZTime(header.Get("DoneRead"))
+		messages = append(messages, msg)
+	}
+}
+
+// setupSAZ loads the sessions of the SAZ archive importPath. exportPath, where the
+// sessions are saved on shutdown, is only checked. Either path may be empty.
+func (p *Proxy) setupSAZ(importPath, exportPath string) error {
+	if p.sessions == nil {
+		if importPath != "" || exportPath != "" {
+			return errors.New("-saz and -import-saz need sessions to be kept; set -max-sessions")
+		}
+		return nil
+	}
+	if importPath == "" {
+		return nil
+	}
+	n, err := p.sessions.loadSAZ(importPath)
+	if err != nil {
+		return fmt.Errorf("failed to import SAZ archive %s: %w", importPath, err)
+	}
+	log.Printf("Imported %d sessions from %s\n", n, importPath)
+	return nil
+}
+
+// exportSAZ saves the sessions held to the SAZ archive at path, logging the outcome
+func (p *Proxy) exportSAZ(path string) {
+	n, err := p.sessions.saveSAZ(path)
+	if err != nil {
+		log.Printf("Failed to write SAZ archive %s: %v\n", path, err)
+		return
+	}
+	log.Printf("Wrote %d sessions to %s\n", n, path)
+}
+
+// loadSAZ adds the sessions of the SAZ archive at path to the store
+func (st *sessionStore) loadSAZ(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	sessions, err := readSAZ(f, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range sessions {
+		st.add(s)
+	}
+	return len(sessions), nil
+}
+
+// saveSAZ writes the finished sessions held to a SAZ archive at path
+func (st *sessionStore) saveSAZ(path string) (int, error) {
+	done := st.finished()
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeSAZ(f, done); err != nil {
+		f.Close()
+		return 0, err
+	}
+	return len(done), f.Close()
+}
+
+// serveSAZ serves the sessions held as a SAZ download
+func (st *sessionStore) serveSAZ(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="netmiddler.saz"`)
+	if err := writeSAZ(w, st.finished()); err != nil {
+		log.Printf("Failed to serve SAZ export: %v\n", err)
+	}
+}
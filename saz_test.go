@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSAZRoundTrip(t *testing.T) {
+	sessions := testSessions()
+	var buf bytes.Buffer
+	if err := writeSAZ(&buf, sessions); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readSAZ(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImported(t, got, sessions)
+
+	// SAZ keeps bodies as relayed, coding and all
+	if got[0].ResponseHeader.Get("Content-Encoding") != "gzip" {
+		t.Error("Content-Encoding dropped")
+	}
+	if body := string(decodedResponse(t, got[0])); body != "<html>compressed page</html>" {
+		t.Errorf("got response body %q", body)
+	}
+	if !bytes.Equal(got[1].ResponseBody.Data, sessions[1].ResponseBody.Data) {
+		t.Errorf("binary body came back as % x", got[1].ResponseBody.Data)
+	}
+	if got[2].ClientAddr != sessions[2].ClientAddr || got[0].ConnectHost != sessions[0].ConnectHost {
+		t.Errorf("got client %s and tunnel %s", got[2].ClientAddr, got[0].ConnectHost)
+	}
+}
+
+// sazArchive zips files into a SAZ archive
+func sazArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		if err := writeZipFile(zw, name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadSAZMalformed(t *testing.T) {
+	request := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	message := func(length string) string {
+		return "Request-From: Client\r\nID: 1\r\nData-Length: " + length + "\r\n\r\n" + string(encodeWSFrame(wsText, []byte("hi")))
+	}
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{"no request", map[string]string{"raw/1_s.txt": "HTTP/1.1 200 OK\r\n\r\n"}, "no request"},
+		{"invalid request", map[string]string{"raw/1_c.txt": "garbage"}, "invalid request"},
+		{"invalid response", map[string]string{"raw/1_c.txt": request, "raw/1_s.txt": "garbage"}, "invalid response"},
+		{"invalid metadata", map[string]string{"raw/1_c.txt": request, "raw/1_m.xml": "<Session"}, "invalid metadata"},
+		{"negative Data-Length", map[string]string{"raw/1_c.txt": request, "raw/1_w.txt": message("-1")}, "invalid Data-Length"},
+		{"Data-Length past the end", map[string]string{"raw/1_c.txt": request, "raw/1_w.txt": message("1000000000")}, "invalid Data-Length"},
+		{"non-numeric Data-Length", map[string]string{"raw/1_c.txt": request, "raw/1_w.txt": message("x")}, "invalid Data-Length"},
+		{"invalid frame", map[string]string{"raw/1_c.txt": request, "raw/1_w.txt": "Request-From: Client\r\nData-Length: 1\r\n\r\n\x81"}, "invalid WebSocket messages"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := sazArchive(t, tt.files)
+			_, err := readSAZ(bytes.NewReader(data), int64(len(data)))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := readSAZ(strings.NewReader("not a zip"), 9); err == nil || !strings.Contains(err.Error(), "invalid SAZ") {
+		t.Errorf("got error %v reading a file which isn't a zip", err)
+	}
+}
+
+func TestSAZWebSocketMessages(t *testing.T) {
+	data := "Request-From: Client\r\nID: 1\r\nData-Length: 7\r\n\r\n" + string(encodeWSFrame(wsText, []byte("hello"))) +
+		"\r\n\r\nRequest-From: Server\r\nID: 2\r\nData-Length: 2\r\n\r\n" + string(encodeWSFrame(wsBinary, nil)) + "\r\n"
+	messages, err := sazWebSocketMessages([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(messages))
+	}
+	if m := messages[0]; m.Direction != wsSend || m.Opcode != wsText || string(m.Payload) != "hello" {
+		t.Errorf("first message: %s %d %q", m.Direction, m.Opcode, m.Payload)
+	}
+	if m := messages[1]; m.Direction != wsReceive || m.Opcode != wsBinary || len(m.Payload) != 0 {
+		t.Errorf("second message: %s %d %q", m.Direction, m.Opcode, m.Payload)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// errScopeUnsupported is returned where interception is configured through the
+// system proxy settings, which apply to every application alike
+var errScopeUnsupported = errors.New("interception scope is only supported on Linux")
+
+// interceptScope limits which local traffic the Linux firewall rules redirect to the proxy.
+// Every criterion which is set must match; the zero value intercepts the whole host.
+type interceptScope struct {
+	UID    *uint32 // owner of the connecting socket
+	GID    *uint32 // group of the connecting socket
+	Cgroup string  // cgroup v2 path, relative to the cgroup2 mount, e.g. /user.slice/app.scope
+	Unit   string  // systemd unit, matched through the cgroup it runs in
+}
+
+// IsZero reports whether the scope covers all traffic
+func (s interceptScope) IsZero() bool {
+	return s.UID == nil && s.GID == nil && s.Cgroup == "" && s.Unit == ""
+}
+
+func (s interceptScope) String() string {
+	if s.IsZero() {
+		return "all traffic"
+	}
+	var parts []string
+	if s.UID != nil {
+		parts = append(parts, fmt.Sprintf("uid %d", *s.UID))
+	}
+	if s.GID != nil {
+		parts = append(parts, fmt.Sprintf("gid %d", *s.GID))
+	}
+	if s.Cgroup != "" {
+		parts = append(parts, "cgroup "+s.Cgroup)
+	}
+	if s.Unit != "" {
+		parts = append(parts, "unit "+s.Unit)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseScope builds an interceptScope from command line values; the user
+// and group may be given by name or numeric id, and empty values are unset
+func parseScope(uid, gid, cgroup, unit string) (interceptScope, error) {
+	scope := interceptScope{Cgroup: cgroup, Unit: unit}
+
+	if uid != "" {
+		id, err := strconv.ParseUint(uid, 10, 32)
+		if err != nil {
+			u, lookupErr := user.Lookup(uid)
+			if lookupErr != nil {
+				return scope, fmt.Errorf("unknown user %q: %v", uid, lookupErr)
+			}
+			if id, err = strconv.ParseUint(u.Uid, 10, 32); err != nil {
+				return scope, fmt.Errorf("user %q has non-numeric uid %s", uid, u.Uid)
+			}
+		}
+		v := uint32(id)
+		scope.UID = &v
+	}
+
+	if gid != "" {
+		id, err := strconv.ParseUint(gid, 10, 32)
+		if err != nil {
+			g, lookupErr := user.LookupGroup(gid)
+			if lookupErr != nil {
+				return scope, fmt.Errorf("unknown group %q: %v", gid, lookupErr)
+			}
+			if id, err = strconv.ParseUint(g.Gid, 10, 32); err != nil {
+				return scope, fmt.Errorf("group %q has non-numeric gid %s", gid, g.Gid)
+			}
+		}
+		v := uint32(id)
+		scope.GID = &v
+	}
+
+	return scope, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// scopeExprs returns the nftables match expressions restricting a rule to scope
+func scopeExprs(scope interceptScope) ([]expr.Any, error) {
+	var exprs []expr.Any
+	if scope.UID != nil {
+		exprs = append(exprs, metaMatch(expr.MetaKeySKUID, *scope.UID)...)
+	}
+	if scope.GID != nil {
+		exprs = append(exprs, metaMatch(expr.MetaKeySKGID, *scope.GID)...)
+	}
+
+	var cgroups []string
+	if scope.Cgroup != "" {
+		cgroups = append(cgroups, scope.Cgroup)
+	}
+	if scope.Unit != "" {
+		cgroup, err := unitCgroup(scope.Unit)
+		if err != nil {
+			return nil, err
+		}
+		cgroups = append(cgroups, cgroup)
+	}
+	for _, cgroup := range cgroups {
+		match, err := cgroupMatch(cgroup)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, match...)
+	}
+
+	return exprs, nil
+}
+
+// metaMatch is equivalent to `meta <key> <value>`
+func metaMatch(key expr.MetaKey, value uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.NativeEndian.PutUint32(value),
+		},
+	}
+}
+
+// cgroupMatch is equivalent to `socket cgroupv2 level <n> "<path>"`, which
+// matches sockets created anywhere beneath the cgroup
+func cgroupMatch(path string) ([]expr.Any, error) {
+	root, err := cgroup2Mount()
+	if err != nil {
+		return nil, err
+	}
+	rel := strings.Trim(strings.TrimPrefix(filepath.Clean(path), root), "/")
+	if rel == "" {
+		return nil, fmt.Errorf("cgroup %q is the root cgroup, which matches everything", path)
+	}
+
+	// The kernel identifies a cgroup v2 by the inode number of its directory
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(root, rel), &st); err != nil {
+		return nil, fmt.Errorf("cgroup %q not found: %v", path, err)
+	}
+
+	return []expr.Any{
+		&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: uint32(strings.Count(rel, "/") + 1), Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.NativeEndian.PutUint64(st.Ino),
+		},
+	}, nil
+}
+
+// cgroup2Mount finds where the unified cgroup hierarchy is mounted, which is
+// /sys/fs/cgroup on modern systems but /sys/fs/cgroup/unified in hybrid setups
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 2 && fields[2] == "cgroup2" {
+			return fields[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no cgroup2 filesystem is mounted")
+}
+
+// unitCgroup asks systemd which cgroup a unit runs in
+func unitCgroup(unit string) (string, error) {
+	out, err := exec.Command("systemctl", "show", "--property=ControlGroup", "--value", unit).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to look up systemd unit %s: %v", unit, err)
+	}
+	cgroup := strings.TrimSpace(string(out))
+	if cgroup == "" {
+		return "", fmt.Errorf("systemd unit %s is not running", unit)
+	}
+	return cgroup, nil
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Defaults for the session store flags
+const (
+	defaultMaxSessions      = 1000
+	defaultMaxSessionBytes  = 256 << 20
+	defaultSessionBodyLimit = 1 << 20
+)
+
+// Session is one transaction seen by the proxy: the request, the response received
+// for it or the error which prevented one, and the WebSocket messages exchanged
+// after an upgrade. Sessions returned by the store are snapshots, safe to read.
+type Session struct {
+	ID uint64 `json:"id"`
+
+	ClientAddr  string `json:"clientAddr"`            // the client's address, host:port
+	ConnectHost string `json:"connectHost,omitempty"` // host of the tunnel an intercepted request arrived through
+	Scheme      string `json:"scheme"`
+
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestProto   string      `json:"requestProto"`
+	RequestHeader  http.Header `json:"requestHeader"`
+	RequestTrailer http.Header `json:"requestTrailer,omitempty"`
+	RequestBody    SessionBody `json:"requestBody"`
+
+	StatusCode      int         `json:"statusCode,omitempty"`
+	Status          string      `json:"status,omitempty"`
+	ResponseProto   string      `json:"responseProto,omitempty"`
+	ResponseHeader  http.Header `json:"responseHeader,omitempty"`
+	ResponseTrailer http.Header `json:"responseTrailer,omitempty"`
+	ResponseBody    SessionBody `json:"responseBody"`
+
+	Timings SessionTimings `json:"timings"`
+	TLS     *SessionTLS    `json:"tls,omitempty"`
+
+	// Error describes why the transaction failed, and TimeoutPhase names the
+	// phase which ran out of time when that was the cause
+	Error        string `json:"error,omitempty"`
+	TimeoutPhase string `json:"timeoutPhase,omitempty"`
+
+	WebSocket []*WebSocketMessage `json:"webSocket,omitempty"`
+
+	// Done is set once the transaction, or the upgraded connection, is over
+	Done bool `json:"done"`
+
+	size    int64 // bytes charged against the store's budget
+	wsBytes int64
+}
+
+// SessionBody is a body as relayed, before any content coding is undone
+type SessionBody struct {
+	Data []byte `json:"data,omitempty"` // at most -session-body-limit bytes
+	Size int64  `json:"size"`           // the size of the whole body
+}
+
+// Truncated reports whether only the start of the body was kept
+func (b SessionBody) Truncated() bool {
+	return int64(len(b.Data)) < b.Size
+}
+
+// SessionTimings are the moments a transaction reached; those it didn't are zero
+type SessionTimings struct {
+	Start       time.Time `json:"start"`       // request received from the client
+	GotConn     time.Time `json:"gotConn"`     // upstream connection obtained
+	RequestSent time.Time `json:"requestSent"` // request, body included, written upstream
+	FirstByte   time.Time `json:"firstByte"`   // first byte of the response received
+	End         time.Time `json:"end"`         // response relayed, or upgraded connection closed
+}
+
+// SessionTLS describes both TLS connections of an intercepted transaction
+type SessionTLS struct {
+	ServerName          string `json:"serverName,omitempty"` // SNI sent by the client
+	ClientVersion       string `json:"clientVersion"`
+	ClientCipherSuite   string `json:"clientCipherSuite"`
+	ClientProtocol      string `json:"clientProtocol,omitempty"` // ALPN protocol agreed with the client
+	UpstreamVersion     string `json:"upstreamVersion,omitempty"`
+	UpstreamCipherSuite string `json:"upstreamCipherSuite,omitempty"`
+	UpstreamProtocol    string `json:"upstreamProtocol,omitempty"`
+	Resumed             bool   `json:"resumed"`               // the upstream TLS session was resumed
+	VerifyError         string `json:"verifyError,omitempty"` // why the target's certificate failed verification
+}
+
+// sessionStore keeps the most recent sessions in memory, within a count and a
+// byte budget, evicting the oldest first. IDs increase monotonically and are
+// never reused, so they stay valid references even once evicted.
+type sessionStore struct {
+	maxCount  int
+	maxBytes  int64
+	bodyLimit int
+
+	mu        sync.Mutex
+	nextID    uint64
+	sessions  []*Session // oldest first
+	byID      map[uint64]*Session
+	bytes     int64
+	observers []func(Session)
+}
+
+// newSessionStore returns a store for up to maxCount sessions taking maxBytes,
+// keeping the first bodyLimit bytes of each body. It returns nil, a store which
+// records nothing, when maxCount is zero.
+func newSessionStore(maxCount int, maxBytes int64, bodyLimit int) *sessionStore {
+	if maxCount <= 0 {
+		return nil
+	}
+	return &sessionStore{
+		maxCount:  maxCount,
+		maxBytes:  maxBytes,
+		bodyLimit: bodyLimit,
+		byID:      make(map[uint64]*Session),
+	}
+}
+
+// get returns a snapshot of the session with the given ID, unless it was evicted
+func (st *sessionStore) get(id uint64) (Session, bool) {
+	if st == nil {
+		return Session{}, false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.byID[id]
+	if !ok {
+		return Session{}, false
+	}
+	return snapshot(s), true
+}
+
+// list returns snapshots of the sessions held, oldest first
+func (st *sessionStore) list() []Session {
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	list := make([]Session, len(st.sessions))
+	for i, s := range st.sessions {
+		list[i] = snapshot(s)
+	}
+	return list
+}
+
+// finished returns snapshots of the sessions held which are done, oldest first
+func (st *sessionStore) finished() []Session {
+	var done []Session
+	for _, s := range st.list() {
+		if s.Done {
+			done = append(done, s)
+		}
+	}
+	return done
+}
+
+// snapshot copies s. Headers, bodies and TLS details are replaced rather than
+// modified, and the WebSocket messages are clipped so later appends don't show.
+func snapshot(s *Session) Session {
+	c := *s
+	c.WebSocket = slices.Clip(s.WebSocket)
+	return c
+}
+
+// observe calls f with a snapshot of each session as it begins and once it is
+// done. f is called without the store locked, but must not block.
+func (st *sessionStore) observe(f func(Session)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.observers = append(st.observers, f)
+}
+
+// notify passes a snapshot of s to the observers
+func (st *sessionStore) notify(s *Session) {
+	st.mu.Lock()
+	snap := snapshot(s)
+	observers := st.observers
+	st.mu.Unlock()
+	for _, f := range observers {
+		f(snap)
+	}
+}
+
+// add stores s under a new ID, which it returns
+func (st *sessionStore) add(s *Session) uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.nextID++
+	s.ID = st.nextID
+	st.sessions = append(st.sessions, s)
+	st.byID[s.ID] = s
+	st.charge(s)
+	return s.ID
+}
+
+// update applies f to s and recharges it against the budget. Evicted sessions
+// are still updated, but no longer count.
+func (st *sessionStore) update(s *Session, f func(s *Session)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	f(s)
+	if st.byID[s.ID] == s {
+		st.charge(s)
+	}
+}
+
+// charge accounts for the current size of s, then evicts the oldest sessions
+// until the store is back within its limits. A session larger than the whole
+// budget is only evicted once a newer one arrives.
+func (st *sessionStore) charge(s *Session) {
+	size := sessionSize(s)
+	st.bytes += size - s.size
+	s.size = size
+	for len(st.sessions) > st.maxCount || (st.bytes > st.maxBytes && len(st.sessions) > 1) {
+		oldest := st.sessions[0]
+		st.sessions[0] = nil
+		st.sessions = st.sessions[1:]
+		delete(st.byID, oldest.ID)
+		st.bytes -= oldest.size
+	}
+}
+
+// sessionSize approximates the memory held by s
+func sessionSize(s *Session) int64 {
+	size := int64(len(s.URL)) + s.wsBytes
+	size += int64(len(s.RequestBody.Data) + len(s.ResponseBody.Data))
+	for _, h := range []http.Header{s.RequestHeader, s.RequestTrailer, s.ResponseHeader, s.ResponseTrailer} {
+		for key, values := range h {
+			for _, value := range values {
+				size += int64(len(key) + len(value))
+			}
+		}
+	}
+	return size
+}
+
+// recording captures one transaction into the store as it is relayed. The nil
+// recording, begun on a store which records nothing, ignores every call.
+type recording struct {
+	store   *sessionStore
+	session *Session
+
+	req      *http.Request
+	resp     *http.Response
+	reqBody  *bodyCapture
+	respBody *bodyCapture
+	once     sync.Once
+}
+
+// begin starts recording the transaction for req, as received from the client
+// over scheme. ConnectHost is taken from the upstreamTarget carried by the
+// request's context, and the client's TLS details from req.TLS.
+func (st *sessionStore) begin(req *http.Request, scheme string) *recording {
+	if st == nil {
+		return nil
+	}
+	s := &Session{
+		ClientAddr:    req.RemoteAddr,
+		Scheme:        scheme,
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		RequestProto:  req.Proto,
+		RequestHeader: req.Header.Clone(),
+		Timings:       SessionTimings{Start: time.Now()},
+	}
+	if target, ok := req.Context().Value(upstreamTargetKey{}).(*upstreamTarget); ok {
+		s.ConnectHost = target.host
+		if req.TLS != nil {
+			s.TLS = &SessionTLS{
+				ServerName:        req.TLS.ServerName,
+				ClientVersion:     tls.VersionName(req.TLS.Version),
+				ClientCipherSuite: tls.CipherSuiteName(req.TLS.CipherSuite),
+				ClientProtocol:    req.TLS.NegotiatedProtocol,
+			}
+			if target.info != nil && target.info.verifyErr != nil {
+				s.TLS.VerifyError = target.info.verifyErr.Error()
+			}
+		}
+	}
+	st.add(s)
+	st.notify(s)
+	return &recording{store: st, session: s, req: req}
+}
+
+// trace returns ctx with hooks timing the round trip made with it
+func (rec *recording) trace(ctx context.Context) context.Context {
+	if rec == nil {
+		return ctx
+	}
+	mark := func(field *time.Time) {
+		rec.store.update(rec.session, func(*Session) { *field = time.Now() })
+	}
+	t := &rec.session.Timings
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn:              func(httptrace.GotConnInfo) { mark(&t.GotConn) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { mark(&t.RequestSent) },
+		GotFirstResponseByte: func() { mark(&t.FirstByte) },
+	})
+}
+
+// captureRequest keeps the body of out, the request forwarded upstream, as the
+// transport sends it
+func (rec *recording) captureRequest(out *http.Request) {
+	if rec == nil || out.Body == nil || out.Body == http.NoBody {
+		return
+	}
+	rec.reqBody = &bodyCapture{limit: rec.store.bodyLimit}
+	out.Body = readCloser{io.TeeReader(out.Body, rec.reqBody), out.Body}
+}
+
+// response records the response headers as received from upstream, and keeps
+// the body as it is relayed. The body of a protocol switch is the upgraded
+// connection, which is left alone.
+func (rec *recording) response(resp *http.Response) {
+	if rec == nil {
+		return
+	}
+	rec.resp = resp
+	rec.store.update(rec.session, func(s *Session) {
+		s.StatusCode = resp.StatusCode
+		s.Status = resp.Status
+		s.ResponseProto = resp.Proto
+		s.ResponseHeader = resp.Header.Clone()
+		if resp.TLS != nil && s.TLS != nil {
+			t := *s.TLS
+			t.UpstreamVersion = tls.VersionName(resp.TLS.Version)
+			t.UpstreamCipherSuite = tls.CipherSuiteName(resp.TLS.CipherSuite)
+			t.UpstreamProtocol = resp.TLS.NegotiatedProtocol
+			t.Resumed = resp.TLS.DidResume
+			s.TLS = &t
+		}
+	})
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.Body != nil && resp.Body != http.NoBody {
+		rec.respBody = &bodyCapture{limit: rec.store.bodyLimit}
+		resp.Body = readCloser{io.TeeReader(resp.Body, rec.respBody), resp.Body}
+	}
+}
+
+// webSocketMessage adds a message relayed over the upgraded connection, keeping
+// no more of its payload than of a body
+func (rec *recording) webSocketMessage(msg *WebSocketMessage) {
+	if rec == nil {
+		return
+	}
+	m := *msg
+	if len(m.Payload) > rec.store.bodyLimit {
+		m.Payload = m.Payload[:rec.store.bodyLimit]
+		m.Truncated = true
+	}
+	m.Payload = slices.Clone(m.Payload)
+	rec.store.update(rec.session, func(s *Session) {
+		s.WebSocket = append(s.WebSocket, &m)
+		s.wsBytes += int64(len(m.Payload))
+	})
+}
+
+// finish completes the session with the bodies and trailers relayed and err, the
+// failure which ended the transaction if any. Only the first call counts.
+func (rec *recording) finish(err error) {
+	if rec == nil {
+		return
+	}
+	rec.once.Do(func() {
+		rec.store.update(rec.session, func(s *Session) {
+			s.Timings.End = time.Now()
+			s.Done = true
+			s.RequestBody = rec.reqBody.body()
+			s.ResponseBody = rec.respBody.body()
+			if len(rec.req.Trailer) > 0 {
+				s.RequestTrailer = rec.req.Trailer.Clone()
+			}
+			if rec.resp != nil && len(rec.resp.Trailer) > 0 {
+				s.ResponseTrailer = rec.resp.Trailer.Clone()
+			}
+			if err != nil {
+				s.Error = err.Error()
+				var te *timeoutError
+				if errors.As(err, &te) {
+					s.TimeoutPhase = te.phase
+				}
+			}
+		})
+		rec.store.notify(rec.session)
+	})
+}
+
+// bodyCapture keeps the first limit bytes written to it and counts the rest. The
+// transport may still be sending a request body when the response is done, so
+// it is safe for concurrent use.
+type bodyCapture struct {
+	limit int
+
+	mu    sync.Mutex
+	data  []byte
+	total int64
+}
+
+func (c *bodyCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total += int64(len(p))
+	if room := c.limit - len(c.data); room > 0 {
+		c.data = append(c.data, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// body returns what was captured, which the capture no longer modifies
+func (c *bodyCapture) body() SessionBody {
+	if c == nil {
+		return SessionBody{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Later writes must not reach the returned data
+	c.data = slices.Clip(c.data)
+	return SessionBody{Data: c.data, Size: c.total}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// shutdownPollInterval is how often shutdown checks whether tracked connections are done
+const shutdownPollInterval = 100 * time.Millisecond
+
+// closeGrace is how long the handlers of connections closed at shutdown get to
+// record how their sessions ended, before the sessions are exported
+const closeGrace = time.Second
+
+// connTracker keeps the connections which are hijacked from, or diverted before,
+// the http.Servers, since Server.Shutdown doesn't wait for those
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// Track adds conn, returning the function which removes it again once handled
+func (t *connTracker) Track(conn net.Conn) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	t.conns[conn] = struct{}{}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.conns, conn)
+	}
+}
+
+// Len returns the number of connections still being handled
+func (t *connTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Wait blocks until every tracked connection is done, or ctx ends
+func (t *connTracker) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for t.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// CloseAll closes every tracked connection, returning how many there were
+func (t *connTracker) CloseAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	return len(t.conns)
+}
+
+// shutdown stops the servers accepting connections, then gives in-flight
+// transactions and tunnels up to timeout to finish before closing them
+func (p *Proxy) shutdown(servers []*http.Server, timeout time.Duration) {
+	log.Printf("Waiting up to %v for open connections to finish\n", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+			}
+		}(server)
+	}
+	// A handler may still be dialing before it hijacks and tracks its tunnel, so
+	// only look at the tunnels once the servers are done with their handlers
+	wg.Wait()
+	if err := p.conns.Wait(ctx); err != nil {
+		log.Printf("Closed %d connections still open after %v\n", p.conns.CloseAll(), timeout)
+		graceCtx, cancel := context.WithTimeout(context.Background(), closeGrace)
+		defer cancel()
+		p.conns.Wait(graceCtx)
+	} else {
+		log.Printf("All connections finished\n")
+	}
+	p.pool.Close()
+	p.closeExports()
+}
+
+// closeExports completes the HAR file and writes the SAZ archive, once no more
+// sessions can finish
+func (p *Proxy) closeExports() {
+	if p.har != nil {
+		if err := p.har.Close(); err != nil {
+			log.Printf("Failed to close HAR file: %v\n", err)
+		}
+	}
+	if p.sazPath != "" {
+		p.exportSAZ(p.sazPath)
+	}
+}
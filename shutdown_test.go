@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestShutdownExportsClosedConns checks a session ended by the forced close at
+// shutdown still reaches the HAR file
+func TestShutdownExportsClosedConns(t *testing.T) {
+	p := newTestProxy(t)
+	p.sessions = newSessionStore(10, 1<<20, 1<<20)
+	path := filepath.Join(t.TempDir(), "capture.har")
+	if err := p.setupHAR("", path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A tunnel which only ends when its connection is closed
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	untrack := p.conns.Track(conn)
+	go func() {
+		defer untrack()
+		rec := p.sessions.begin(httptest.NewRequest("GET", "http://example.com/stream", nil), "http")
+		_, err := conn.Read(make([]byte, 1))
+		rec.finish(err)
+	}()
+
+	p.shutdown(nil, 50*time.Millisecond)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sessions, err := readHAR(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].URL != "http://example.com/stream" {
+		t.Fatalf("HAR file holds %d sessions, want the one closed at shutdown", len(sessions))
+	}
+}
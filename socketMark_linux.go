@@ -0,0 +1,15 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// upstreamMark tags NetMiddler's own upstream sockets ("NM"), which the
+// nftables rules exempt from redirection
+const upstreamMark = 0x4e4d
+
+// markSocket sets upstreamMark on a socket; this requires CAP_NET_ADMIN,
+// which installing the nftables rules needs anyway
+func markSocket(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, upstreamMark)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// markSocket is a no-op where the system proxy settings, rather than a
+// firewall redirect, send traffic to NetMiddler
+func markSocket(fd uintptr) error {
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SOCKS protocol constants (RFC 1928, RFC 1929 and the SOCKS4/4a specifications)
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socksCmdConnect = 0x01
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xFF
+
+	socksPasswordAuthVersion = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socks5Succeeded        = 0x00
+	socks5NotAllowed       = 0x02
+	socks5HostUnreachable  = 0x04
+	socks5ConnRefused      = 0x05
+	socks5CmdNotSupported  = 0x07
+	socks5AtypNotSupported = 0x08
+
+	socks4Granted  = 0x5A
+	socks4Rejected = 0x5B
+
+	// socks4MaxField caps the NUL terminated user ID and host name of SOCKS4a
+	socks4MaxField = 255
+)
+
+// newSOCKSListener accepts SOCKS5 and SOCKS4a clients. Connections to ports 80 and
+// 443 are inspected like any other proxied traffic: TLS is intercepted directly and
+// plain HTTP is handed to the http.Server. Other ports are relayed untouched.
+func newSOCKSListener(ln net.Listener, p *Proxy) net.Listener {
+	l := newDivertingListener(ln, p)
+	l.divert = l.serveSOCKS
+	go l.acceptLoop()
+	return l
+}
+
+// serveSOCKS performs the SOCKS handshake with a client, then routes its tunnel
+func (l *divertingListener) serveSOCKS(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	version, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	var dst string
+	var reply func(code byte) error
+	switch version[0] {
+	case socks5Version:
+		dst, reply, err = l.proxy.socks5Handshake(br, conn)
+	case socks4Version:
+		dst, reply, err = l.proxy.socks4Handshake(br, conn)
+	default:
+		err = fmt.Errorf("unknown SOCKS version %d", version[0])
+	}
+	if err != nil {
+		log.Printf("SOCKS handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	_, port, _ := net.SplitHostPort(dst)
+	if port != "80" && port != "443" {
+		defer conn.Close()
+		l.proxy.relaySOCKS(&peekedConn{Conn: conn, reader: br}, dst, reply)
+		return
+	}
+
+	// TLS is expected on 443, so connect first and report any failure in the reply.
+	// Plain HTTP is forwarded by the http.Server, which connects by itself.
+	var target *upstreamTarget
+	if port == "443" {
+		if target, err = l.proxy.connectTarget(dst, dst); err != nil {
+			log.Printf("SOCKS connection to %s failed: %v\n", dst, err)
+			reply(socks5ReplyCode(err))
+			conn.Close()
+			return
+		}
+		defer target.Close()
+	}
+	if err := reply(socks5Succeeded); err != nil {
+		conn.Close()
+		return
+	}
+	first, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	clientConn := &redirectedConn{peekedConn: peekedConn{Conn: conn, reader: br}, dst: dst}
+	if first[0] != recordTypeHandshake {
+		l.deliver(clientConn)
+		return
+	}
+
+	log.Printf("Intercepting TLS tunnelled over SOCKS for %s\n", dst)
+	defer clientConn.Close()
+	if target == nil {
+		if target, err = l.proxy.connectTarget(dst, dst); err != nil {
+			log.Printf("Failed to connect to target server %s: %v\n", dst, err)
+			return
+		}
+		defer target.Close()
+	}
+	l.proxy.interceptTLS(clientConn, target, dst)
+}
+
+// socks5Handshake negotiates authentication and reads a CONNECT request, returning
+// its destination and a function sending the final reply
+func (p *Proxy) socks5Handshake(r *bufio.Reader, w io.Writer) (string, func(byte) error, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", nil, err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", nil, err
+	}
+
+	method := byte(socksAuthNone)
+	if p.socksUser != "" {
+		method = socksAuthPassword
+	}
+	if !slices.Contains(methods, method) {
+		w.Write([]byte{socks5Version, socksAuthNoAcceptable})
+		return "", nil, errors.New("client does not support the required authentication method")
+	}
+	if _, err := w.Write([]byte{socks5Version, method}); err != nil {
+		return "", nil, err
+	}
+	if method == socksAuthPassword {
+		if err := p.socks5Authenticate(r, w); err != nil {
+			return "", nil, err
+		}
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return "", nil, err
+	}
+	reply := func(code byte) error {
+		_, err := w.Write([]byte{socks5Version, code, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", nil, err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		length, err := r.ReadByte()
+		if err != nil {
+			return "", nil, err
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", nil, err
+		}
+		host = string(name)
+	default:
+		reply(socks5AtypNotSupported)
+		return "", nil, fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", nil, err
+	}
+
+	if req[1] != socksCmdConnect {
+		reply(socks5CmdNotSupported)
+		return "", nil, fmt.Errorf("unsupported command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), reply, nil
+}
+
+// socks5Authenticate checks the client's username and password (RFC 1929)
+func (p *Proxy) socks5Authenticate(r *bufio.Reader, w io.Writer) error {
+	readField := func() (string, error) {
+		length, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		field := make([]byte, length)
+		_, err = io.ReadFull(r, field)
+		return string(field), err
+	}
+
+	if version, err := r.ReadByte(); err != nil {
+		return err
+	} else if version != socksPasswordAuthVersion {
+		return fmt.Errorf("unknown authentication version %d", version)
+	}
+	user, err := readField()
+	if err != nil {
+		return err
+	}
+	password, err := readField()
+	if err != nil {
+		return err
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(p.socksUser))
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(p.socksPassword))
+	if userOK&passwordOK != 1 {
+		w.Write([]byte{socksPasswordAuthVersion, 0x01})
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, err = w.Write([]byte{socksPasswordAuthVersion, 0x00})
+	return err
+}
+
+// socks4Handshake reads a SOCKS4 or SOCKS4a CONNECT request, returning its
+// destination and a function sending the final reply
+func (p *Proxy) socks4Handshake(r *bufio.Reader, w io.Writer) (string, func(byte) error, error) {
+	var req [8]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return "", nil, err
+	}
+	if _, err := readSOCKS4Field(r); err != nil { // user ID
+		return "", nil, err
+	}
+	reply := func(code byte) error {
+		status := byte(socks4Granted)
+		if code != socks5Succeeded {
+			status = socks4Rejected
+		}
+		_, err := w.Write([]byte{0x00, status, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+
+	host := net.IP(req[4:8]).String()
+	// SOCKS4a signals a domain name with the address 0.0.0.x, x != 0
+	if req[4] == 0 && req[5] == 0 && req[6] == 0 && req[7] != 0 {
+		name, err := readSOCKS4Field(r)
+		if err != nil {
+			return "", nil, err
+		}
+		host = name
+	}
+
+	// SOCKS4 has no passwords to check
+	if p.socksUser != "" {
+		reply(socks5NotAllowed)
+		return "", nil, errors.New("SOCKS4 clients can't authenticate")
+	}
+	if req[1] != socksCmdConnect {
+		reply(socks5CmdNotSupported)
+		return "", nil, fmt.Errorf("unsupported command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(req[2:4])))), reply, nil
+}
+
+// readSOCKS4Field reads a NUL terminated field of at most socks4MaxField bytes
+func readSOCKS4Field(r *bufio.Reader) (string, error) {
+	var field []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		} else if b == 0 {
+			return string(field), nil
+		} else if len(field) == socks4MaxField {
+			return "", fmt.Errorf("SOCKS4 field longer than %d bytes", socks4MaxField)
+		}
+		field = append(field, b)
+	}
+}
+
+// relaySOCKS connects to dst and copies raw bytes both ways, logging the volume
+func (p *Proxy) relaySOCKS(client net.Conn, dst string, reply func(byte) error) {
+	upstream, err := p.dialUpstream(context.Background(), dst, dst)
+	if err != nil {
+		log.Printf("SOCKS connection to %s failed: %v\n", dst, err)
+		reply(socks5ReplyCode(err))
+		return
+	}
+	defer upstream.Close()
+	if err := reply(socks5Succeeded); err != nil {
+		return
+	}
+	// From here on the tunnel's idle timeout applies
+	client.SetReadDeadline(time.Time{})
+
+	log.Printf("SOCKS relaying %s to %s\n", client.RemoteAddr(), dst)
+	var sent, received int64
+	err = tunnel(client, upstream, p.timeouts.idle,
+		func(dst io.Writer) (err error) { sent, err = io.Copy(dst, client); return err },
+		func(dst io.Writer) (err error) { received, err = io.Copy(dst, upstream); return err })
+	if err != nil && !isClosedConnError(err) {
+		log.Printf("SOCKS relay to %s failed: %v\n", dst, err)
+	}
+	log.Printf("SOCKS relay to %s closed (%d bytes sent, %d bytes received)\n", dst, sent, received)
+}
+
+// socks5ReplyCode is the SOCKS5 reply reporting a failure to connect
+func socks5ReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, errProxyLoop):
+		return socks5NotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnRefused
+	}
+	return socks5HostUnreachable
+}
+
+// parseSOCKSAuth splits the -socks-auth user:password flag
+func parseSOCKSAuth(s string) (user, password string, err error) {
+	if s == "" {
+		return "", "", nil
+	}
+	user, password, ok := strings.Cut(s, ":")
+	if !ok || user == "" {
+		return "", "", errors.New("-socks-auth must be user:password")
+	}
+	return user, password, nil
+}
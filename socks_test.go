@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSOCKS5Handshake(t *testing.T) {
+	domainConnect := []byte{socks5Version, socksCmdConnect, 0, socksAtypDomain, 11}
+	domainConnect = append(domainConnect, "example.com"...)
+	domainConnect = append(domainConnect, 0x01, 0xBB)
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		input    []byte
+		dst      string
+		reply    []byte // written before the CONNECT reply
+		wantErr  string
+	}{
+		{
+			name:  "domain",
+			input: append([]byte{socks5Version, 1, socksAuthNone}, domainConnect...),
+			dst:   "example.com:443",
+			reply: []byte{socks5Version, socksAuthNone},
+		},
+		{
+			name:  "IPv4",
+			input: []byte{socks5Version, 1, socksAuthNone, socks5Version, socksCmdConnect, 0, socksAtypIPv4, 10, 0, 0, 1, 0, 80},
+			dst:   "10.0.0.1:80",
+			reply: []byte{socks5Version, socksAuthNone},
+		},
+		{
+			name: "IPv6",
+			input: append([]byte{socks5Version, 1, socksAuthNone, socks5Version, socksCmdConnect, 0, socksAtypIPv6},
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1F, 0x90),
+			dst:   "[2001:db8::1]:8080",
+			reply: []byte{socks5Version, socksAuthNone},
+		},
+		{
+			name:     "password",
+			user:     "alice",
+			password: "secret",
+			input:    append([]byte{socks5Version, 2, socksAuthNone, socksAuthPassword, socksPasswordAuthVersion, 5, 'a', 'l', 'i', 'c', 'e', 6, 's', 'e', 'c', 'r', 'e', 't'}, domainConnect...),
+			dst:      "example.com:443",
+			reply:    []byte{socks5Version, socksAuthPassword, socksPasswordAuthVersion, 0x00},
+		},
+		{
+			name:     "wrong password",
+			user:     "alice",
+			password: "secret",
+			input:    append([]byte{socks5Version, 1, socksAuthPassword, socksPasswordAuthVersion, 5, 'a', 'l', 'i', 'c', 'e', 6, 's', 'e', 'c', 'r', 'e', 'T'}, domainConnect...),
+			reply:    []byte{socks5Version, socksAuthPassword, socksPasswordAuthVersion, 0x01},
+			wantErr:  "authentication failed",
+		},
+		{
+			name:    "password required",
+			user:    "alice",
+			input:   append([]byte{socks5Version, 1, socksAuthNone}, domainConnect...),
+			reply:   []byte{socks5Version, socksAuthNoAcceptable},
+			wantErr: "authentication method",
+		},
+		{
+			name:    "unsupported command",
+			input:   []byte{socks5Version, 1, socksAuthNone, socks5Version, 0x02, 0, socksAtypIPv4, 10, 0, 0, 1, 0, 80},
+			reply:   []byte{socks5Version, socksAuthNone, socks5Version, socks5CmdNotSupported},
+			wantErr: "unsupported command",
+		},
+		{
+			name:    "unsupported address type",
+			input:   []byte{socks5Version, 1, socksAuthNone, socks5Version, socksCmdConnect, 0, 0x09},
+			reply:   []byte{socks5Version, socksAuthNone, socks5Version, socks5AtypNotSupported},
+			wantErr: "unsupported address type",
+		},
+		{
+			name:    "truncated methods",
+			input:   []byte{socks5Version, 3, socksAuthNone},
+			wantErr: "EOF",
+		},
+		{
+			name:    "truncated domain",
+			input:   []byte{socks5Version, 1, socksAuthNone, socks5Version, socksCmdConnect, 0, socksAtypDomain, 20, 'e', 'x'},
+			reply:   []byte{socks5Version, socksAuthNone},
+			wantErr: "EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{socksUser: tt.user, socksPassword: tt.password}
+			var w bytes.Buffer
+			dst, _, err := p.socks5Handshake(bufio.NewReader(bytes.NewReader(tt.input)), &w)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if dst != tt.dst {
+				t.Errorf("got destination %q, want %q", dst, tt.dst)
+			}
+			if !bytes.HasPrefix(w.Bytes(), tt.reply) {
+				t.Errorf("client was sent % x, want it to start with % x", w.Bytes(), tt.reply)
+			}
+		})
+	}
+}
+
+func TestSOCKS4Handshake(t *testing.T) {
+	long := strings.Repeat("x", socks4MaxField+1)
+	tests := []struct {
+		name    string
+		user    string
+		input   string
+		dst     string
+		wantErr string
+	}{
+		{name: "SOCKS4", input: "\x04\x01\x00\x50\x0a\x00\x00\x01bob\x00", dst: "10.0.0.1:80"},
+		{name: "SOCKS4a", input: "\x04\x01\x01\xbb\x00\x00\x00\x01bob\x00example.com\x00", dst: "example.com:443"},
+		{name: "empty user ID", input: "\x04\x01\x00\x50\x0a\x00\x00\x01\x00", dst: "10.0.0.1:80"},
+		{name: "user ID too long", input: "\x04\x01\x00\x50\x0a\x00\x00\x01" + long + "\x00", wantErr: "longer than"},
+		{name: "host too long", input: "\x04\x01\x01\xbb\x00\x00\x00\x01\x00" + long + "\x00", wantErr: "longer than"},
+		{name: "unterminated user ID", input: "\x04\x01\x00\x50\x0a\x00\x00\x01bob", wantErr: "EOF"},
+		{name: "unsupported command", input: "\x04\x02\x00\x50\x0a\x00\x00\x01\x00", wantErr: "unsupported command"},
+		{name: "authentication required", user: "alice", input: "\x04\x01\x00\x50\x0a\x00\x00\x01\x00", wantErr: "can't authenticate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{socksUser: tt.user}
+			var w bytes.Buffer
+			dst, reply, err := p.socks4Handshake(bufio.NewReader(strings.NewReader(tt.input)), &w)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dst != tt.dst {
+				t.Errorf("got destination %q, want %q", dst, tt.dst)
+			}
+			reply(socks5Succeeded)
+			if want := []byte{0x00, socks4Granted, 0, 0, 0, 0, 0, 0}; !bytes.Equal(w.Bytes(), want) {
+				t.Errorf("replied % x, want % x", w.Bytes(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateFileName records the system settings in place before enableProxy changed them,
+// so they can be restored even if the proxy dies without running its cleanup. It is
+// kept in the user's config directory, so any later run finds it wherever it starts.
+const stateFileName = "state.json"
+
+// stateFile returns the path of the state file, creating its directory
+func stateFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find a directory for the state file: %v", err)
+	}
+	dir = filepath.Join(dir, "netmiddler")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, stateFileName), nil
+}
+
+// proxyState is the content of the state file; System is defined per platform
+type proxyState struct {
+	PID     int         `json:"pid"`
+	Port    int         `json:"port"`
+	Started time.Time   `json:"started"`
+	System  systemState `json:"system"`
+}
+
+// saveProxyState captures the current system settings and writes them to the state file
+func saveProxyState(port int) error {
+	path, err := stateFile()
+	if err != nil {
+		return err
+	}
+	system, err := captureSystemState()
+	if err != nil {
+		return fmt.Errorf("failed to capture system proxy settings: %v", err)
+	}
+	data, err := json.MarshalIndent(proxyState{
+		PID:     os.Getpid(),
+		Port:    port,
+		Started: time.Now(),
+		System:  system,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write via rename so a crash can't leave a truncated state file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadProxyState reads the state file at path, returning nil if there is none
+func loadProxyState(path string) (*proxyState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state proxyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return &state, nil
+}
+
+// restoreProxyState replays the settings recorded in the state file, if any, and removes it.
+// Unless force is set, the state of another NetMiddler which is still running is left alone.
+func restoreProxyState(force bool) error {
+	path, err := stateFile()
+	if err != nil {
+		return err
+	}
+	state, err := loadProxyState(path)
+	if err != nil || state == nil {
+		return err
+	}
+	if !force && state.PID != os.Getpid() && processAlive(state.PID) {
+		return fmt.Errorf("NetMiddler appears to be running already (pid %d); use -restore to override", state.PID)
+	}
+	if state.PID != os.Getpid() {
+		fmt.Printf("Restoring system proxy settings left by a previous run (pid %d, port %d, started %s)\n",
+			state.PID, state.Port, state.Started.Format(time.RFC3339))
+	}
+
+	if err := restoreSystemState(state.System); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// cleanupProxy reverts the system to the settings recorded before enableProxy
+func cleanupProxy() {
+	fmt.Println("Cleaning up proxy on exit")
+	if err := restoreProxyState(true); err != nil {
+		fmt.Printf("Error restoring proxy settings: %v\n", err)
+		disableProxy()
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptrace"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the timeout flags
+const (
+	defaultDialTimeout           = 10 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 60 * time.Second
+	defaultClientIdleTimeout     = 2 * time.Minute
+)
+
+// timeouts bounds each network phase, on the client side as well as the upstream
+// side. A zero duration disables that timeout.
+type timeouts struct {
+	dial           time.Duration // connecting to a target server or parent proxy
+	tlsHandshake   time.Duration // reading the ClientHello and either TLS handshake
+	responseHeader time.Duration // waiting for response headers once the request is sent
+	idle           time.Duration // clients between requests, and tunnels without traffic
+	transaction    time.Duration // a whole request and response, body included
+}
+
+// Phases reported by timeoutError
+const (
+	phaseDial              = "upstream dial"
+	phaseClientHandshake   = "client TLS handshake"
+	phaseUpstreamHandshake = "upstream TLS handshake"
+	phaseResponseHeader    = "upstream response header"
+	phaseTransaction       = "transaction"
+	phaseClientIdle        = "client idle"
+	phaseTunnelIdle        = "tunnel idle"
+)
+
+// timeoutError reports which phase ran out of time, so timeouts can be told apart
+// from other failures. It is a net.Error whose Timeout method returns true.
+type timeoutError struct {
+	phase string
+	limit time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.phase, e.limit)
+}
+
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// asTimeout turns err into a timeoutError for phase when it is due to a deadline.
+// Errors already naming their phase are left alone.
+func asTimeout(err error, phase string, limit time.Duration) error {
+	var te *timeoutError
+	if err == nil || limit <= 0 || errors.As(err, &te) {
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &timeoutError{phase: phase, limit: limit}
+	}
+	return err
+}
+
+// roundTripProgress records how far a round trip got, so a deadline can be blamed
+// on the phase it interrupted
+type roundTripProgress struct {
+	tlsStarted atomic.Bool
+	tlsDone    atomic.Bool // the TLS handshake succeeded
+	gotConn    atomic.Bool
+}
+
+// traceProgress returns ctx with hooks noting the round trip's progress
+func traceProgress(ctx context.Context) (context.Context, *roundTripProgress) {
+	progress := &roundTripProgress{}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { progress.tlsStarted.Store(true) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			progress.tlsDone.Store(err == nil)
+		},
+		GotConn: func(httptrace.GotConnInfo) { progress.gotConn.Store(true) },
+	}), progress
+}
+
+// roundTripError names the phase of a failed round trip which ran out of time, if
+// any. ctx is the transaction's context, bounded by the transaction timeout, and
+// progress was traced with it.
+func (t timeouts) roundTripError(ctx context.Context, progress *roundTripProgress, err error) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return asTimeout(err, phaseTransaction, t.transaction)
+	case progress.tlsStarted.Load() && !progress.tlsDone.Load():
+		return asTimeout(err, phaseUpstreamHandshake, t.tlsHandshake)
+	case !progress.gotConn.Load():
+		return asTimeout(err, phaseDial, t.dial)
+	}
+	return asTimeout(err, phaseResponseHeader, t.responseHeader)
+}
+
+// bodyError names the phase of a failure relaying a response body, once the
+// round trip is over. Only the transaction timeout bounds the body, so other
+// failures are left as they are.
+func (t timeouts) bodyError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return asTimeout(err, phaseTransaction, t.transaction)
+	}
+	return err
+}
+
+// withTimeout bounds ctx by d, unless d is zero
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// deadline returns the time d from now, or no deadline when d is zero
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// activityWriter calls touch whenever data is written, to keep a tunnel's idle timer from firing
+type activityWriter struct {
+	w     io.Writer
+	touch func()
+}
+
+func (a activityWriter) Write(p []byte) (int, error) {
+	a.touch()
+	return a.w.Write(p)
+}
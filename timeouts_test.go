@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRoundTripError(t *testing.T) {
+	limits := timeouts{dial: time.Second, tlsHandshake: 4 * time.Second, responseHeader: 2 * time.Second, transaction: 3 * time.Second}
+	deadlineErr := os.ErrDeadlineExceeded
+
+	ctx, progress := traceProgress(context.Background())
+	if err := limits.roundTripError(ctx, progress, deadlineErr); err.Error() != "upstream dial timed out after 1s" {
+		t.Errorf("before a connection: %v", err)
+	}
+	other := errors.New("connection refused")
+	if err := limits.roundTripError(ctx, progress, other); err != other {
+		t.Errorf("a failure without a deadline became %v", err)
+	}
+
+	progress.tlsStarted.Store(true)
+	if err := limits.roundTripError(ctx, progress, deadlineErr); err.Error() != "upstream TLS handshake timed out after 4s" {
+		t.Errorf("during the TLS handshake: %v", err)
+	}
+	progress.tlsDone.Store(true)
+	progress.gotConn.Store(true)
+	if err := limits.roundTripError(ctx, progress, deadlineErr); err.Error() != "upstream response header timed out after 2s" {
+		t.Errorf("after a connection: %v", err)
+	}
+
+	expired, cancel := context.WithDeadline(ctx, time.Now())
+	defer cancel()
+	<-expired.Done()
+	if err := limits.roundTripError(expired, progress, context.DeadlineExceeded); err.Error() != "transaction timed out after 3s" {
+		t.Errorf("past the transaction deadline: %v", err)
+	}
+}
+
+func TestBodyError(t *testing.T) {
+	limits := timeouts{responseHeader: 2 * time.Second, transaction: 3 * time.Second}
+
+	// A body cut off by something other than the transaction deadline is no response-header timeout
+	if err := limits.bodyError(context.Background(), os.ErrDeadlineExceeded); err != os.ErrDeadlineExceeded {
+		t.Errorf("got %v", err)
+	}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	<-expired.Done()
+	if err := limits.bodyError(expired, context.DeadlineExceeded); err.Error() != "transaction timed out after 3s" {
+		t.Errorf("past the transaction deadline: %v", err)
+	}
+}
+
+// TestRoundTripErrorTLSHandshake lets a transport's TLS handshake time out against a
+// server which never answers it
+func TestRoundTripErrorTLSHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	limits := timeouts{dial: time.Second, tlsHandshake: 50 * time.Millisecond, responseHeader: time.Second}
+	transport := &http.Transport{TLSHandshakeTimeout: limits.tlsHandshake}
+	defer transport.CloseIdleConnections()
+
+	ctx, progress := traceProgress(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://"+l.Addr().String(), nil)
+	_, err = transport.RoundTrip(req)
+	if err == nil {
+		t.Fatal("round trip without a TLS handshake succeeded")
+	}
+	if err := limits.roundTripError(ctx, progress, err); err.Error() != "upstream TLS handshake timed out after 50ms" {
+		t.Errorf("got %v", err)
+	}
+}
+
+// TestTraceProgress checks the GotConn hook fires through a real round trip
+func TestTraceProgress(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer s.Close()
+
+	ctx, progress := traceProgress(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !progress.gotConn.Load() {
+		t.Error("GotConn was not recorded")
+	}
+
+	// Nothing listens on a closed listener's address, so no connection is had
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	l.Close()
+	ctx, progress = traceProgress(context.Background())
+	req, _ = http.NewRequestWithContext(ctx, "GET", "http://"+l.Addr().String(), nil)
+	if _, err := http.DefaultTransport.RoundTrip(req); err == nil {
+		t.Fatal("round trip to a closed port succeeded")
+	}
+	if progress.gotConn.Load() {
+		t.Error("GotConn recorded without a connection")
+	}
+}
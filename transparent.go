@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// recordTypeHandshake is the first byte of a TLS connection
+const recordTypeHandshake = 0x16
+
+// originalDstKey is the context key holding the host:port a connection was
+// originally headed for, before being redirected or tunnelled to the proxy
+type originalDstKey struct{}
+
+// divertingListener accepts connections for the proxy, passing each one to divert,
+// which either handles it itself or hands it to deliver so that Accept returns it
+// to the http.Server. Diverting happens off the accept loop, since it usually
+// blocks until the client speaks.
+type divertingListener struct {
+	net.Listener
+	proxy  *Proxy
+	divert func(conn net.Conn)
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newDivertingListener(ln net.Listener, p *Proxy) *divertingListener {
+	return &divertingListener{
+		Listener: ln,
+		proxy:    p,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+}
+
+// newTransparentListener diverts the connections which were redirected by the
+// firewall rules (see enableProxy) rather than sent to the proxy explicitly.
+// Redirected TLS is intercepted directly, while redirected plain HTTP is handed
+// to the http.Server alongside regular proxy connections.
+func newTransparentListener(ln net.Listener, p *Proxy) net.Listener {
+	l := newDivertingListener(ln, p)
+	l.divert = l.classify
+	go l.acceptLoop()
+	return l
+}
+
+func (l *divertingListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *divertingListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *divertingListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			defer l.proxy.conns.Track(conn)()
+			// A client which never gets to the point is dropped like an idle one
+			conn.SetReadDeadline(deadline(l.proxy.timeouts.idle))
+			l.divert(conn)
+		}()
+	}
+}
+
+// classify routes a newly accepted connection based on where it was originally headed
+func (l *divertingListener) classify(conn net.Conn) {
+	dst, err := originalDst(conn)
+	if err != nil || isLocalAddr(conn, dst) {
+		l.deliver(conn)
+		return
+	}
+
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if first[0] != recordTypeHandshake {
+		l.deliver(&redirectedConn{peekedConn: peekedConn{Conn: conn, reader: br}, dst: dst.String()})
+		return
+	}
+
+	hello, replay, err := peekClientHello(br)
+	if err != nil {
+		log.Printf("Failed to read TLS ClientHello redirected for %s: %v\n", dst, err)
+		conn.Close()
+		return
+	}
+	// Without SNI the best name we have is the original IP address
+	host := dst.IP.String()
+	if hello.ServerName != "" {
+		host = hello.ServerName
+	}
+	log.Printf("Transparently intercepting TLS for %s (%s)\n", host, dst)
+
+	clientConn := &redirectedConn{peekedConn: peekedConn{Conn: conn, reader: replay}, dst: dst.String()}
+	defer clientConn.Close()
+
+	// The client believes it is connected already, so a failure can only be
+	// reported by hanging up
+	host = net.JoinHostPort(host, strconv.Itoa(dst.Port))
+	target, err := l.proxy.connectTarget(host, dst.String())
+	if err != nil {
+		log.Printf("Failed to connect to target server %s: %v\n", dst, err)
+		return
+	}
+	defer target.Close()
+	l.proxy.interceptTLS(clientConn, target, host)
+}
+
+func (l *divertingListener) deliver(conn net.Conn) {
+	// The http.Server applies its own timeouts
+	conn.SetReadDeadline(time.Time{})
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// isLocalAddr reports whether dst is the address the connection actually arrived on
+func isLocalAddr(conn net.Conn, dst *net.TCPAddr) bool {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	return !ok || (local.IP.Equal(dst.IP) && local.Port == dst.Port)
+}
+
+// connContext records the original destination of redirected connections for ServeHTTP
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	if rc, ok := c.(*redirectedConn); ok {
+		return context.WithValue(ctx, originalDstKey{}, rc.dst)
+	}
+	return ctx
+}
+
+// peekedConn replays the bytes already peeked from a connection through reader
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite half-closes the underlying connection, so wrapping doesn't hide it
+func (c *peekedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// redirectedConn is a connection which reached the proxy through a firewall
+// redirect or a SOCKS tunnel, originally headed for dst (host:port)
+type redirectedConn struct {
+	peekedConn
+	dst string
+}
+
+// errHelloPeeked aborts the handshake used by peekClientHello
+var errHelloPeeked = errors.New("client hello peeked")
+
+// peekClientHello parses the TLS ClientHello from r, returning it along with
+// a reader which replays everything consumed from r
+func peekClientHello(r io.Reader) (*tls.ClientHelloInfo, io.Reader, error) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{io.TeeReader(r, &buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *h
+			return nil, errHelloPeeked
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, nil, err
+	}
+	hello.Conn = nil
+	return hello, io.MultiReader(&buf, r), nil
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello without answering it
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
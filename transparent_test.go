@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// clientHello returns the bytes a TLS client sends first for serverName
+func clientHello(t *testing.T, serverName string, protos ...string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: protos, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestPeekClientHello(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string
+		protos     []string
+	}{
+		{"SNI", "example.com", []string{"h2", "http/1.1"}},
+		{"no SNI", "", nil}, // as for an IP address
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := clientHello(t, tt.serverName, tt.protos...)
+			hello, replay, err := peekClientHello(bytes.NewReader(append(data, "more"...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hello.ServerName != tt.serverName {
+				t.Errorf("got SNI %q, want %q", hello.ServerName, tt.serverName)
+			}
+			if len(hello.SupportedProtos) != len(tt.protos) {
+				t.Errorf("got protocols %q, want %q", hello.SupportedProtos, tt.protos)
+			}
+			// Everything read is replayed, followed by what wasn't
+			replayed, _ := io.ReadAll(replay)
+			if !bytes.Equal(replayed, append(data, "more"...)) {
+				t.Errorf("replayed %d bytes, want %d", len(replayed), len(data)+4)
+			}
+		})
+	}
+
+	if _, _, err := peekClientHello(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n"))); err == nil {
+		t.Error("peeked a ClientHello from plain HTTP")
+	}
+}
+
+// TestRedirectedHTTP sends origin-form requests as redirected connections deliver
+// them; the Host header names the target, and the original destination stands in
+// when there is none
+func TestRedirectedHTTP(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "reached "+r.URL.Path)
+	}))
+	defer upstream.Close()
+	p := newTestProxy(t)
+	dst := upstream.Listener.Addr().String()
+
+	tests := []struct {
+		name       string
+		host       string
+		redirected bool
+		wantCode   int
+		wantBody   string
+	}{
+		{"Host header", dst, true, http.StatusOK, "reached /path"},
+		{"original destination", "", true, http.StatusOK, "reached /path"},
+		{"addressed to the proxy", dst, false, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/path", nil)
+			req.Host = tt.host
+			if tt.redirected {
+				req = req.WithContext(context.WithValue(req.Context(), originalDstKey{}, dst))
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("got %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+// TestTransparentListenerDelivers checks a connection which wasn't redirected is
+// handed to the http.Server unchanged
+func TestTransparentListenerDelivers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTransparentListener(ln, newTestProxy(t))
+	defer l.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		if _, redirected := conn.(*redirectedConn); redirected {
+			t.Error("a direct connection was treated as redirected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not delivered")
+	}
+}
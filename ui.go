@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultUIAddr is the default of -ui-addr. The UI shows everything captured,
+// so it only listens on loopback unless told otherwise.
+const defaultUIAddr = "127.0.0.1:8889"
+
+// uiEventBuffer is how many session events a slow browser may fall behind by
+// before its stream is dropped; it reconnects and reloads the list
+const uiEventBuffer = 256
+
+// uiBodyLimit caps a body decoded for display in the UI
+const uiBodyLimit = 4 << 20
+
+//go:embed ui
+var uiFiles embed.FS
+
+// sessionSummary is a row of the UI's session list
+type sessionSummary struct {
+	ID           uint64    `json:"id"`
+	Method       string    `json:"method"`
+	URL          string    `json:"url"`
+	Host         string    `json:"host"`
+	StatusCode   int       `json:"statusCode"`
+	ContentType  string    `json:"contentType,omitempty"`
+	ResponseSize int64     `json:"responseSize"`
+	Start        time.Time `json:"start"`
+	Duration     float64   `json:"duration"` // milliseconds, once done
+	Done         bool      `json:"done"`
+	Error        string    `json:"error,omitempty"`
+	WebSocket    int       `json:"webSocket,omitempty"`
+	ClientAddr   string    `json:"clientAddr"`
+}
+
+func summarize(s Session) sessionSummary {
+	sum := sessionSummary{
+		ID:           s.ID,
+		Method:       s.Method,
+		URL:          s.URL,
+		Host:         s.ConnectHost,
+		StatusCode:   s.StatusCode,
+		ContentType:  s.ResponseHeader.Get("Content-Type"),
+		ResponseSize: s.ResponseBody.Size,
+		Start:        s.Timings.Start,
+		Done:         s.Done,
+		Error:        s.Error,
+		WebSocket:    len(s.WebSocket),
+		ClientAddr:   s.ClientAddr,
+	}
+	if u, err := url.Parse(s.URL); err == nil && u.Host != "" {
+		sum.Host = u.Host
+	}
+	if s.Done && !s.Timings.End.IsZero() {
+		sum.Duration = float64(s.Timings.End.Sub(s.Timings.Start).Microseconds()) / 1000
+	}
+	return sum
+}
+
+// sessionDetail is a session as the UI's detail view shows it, with the bodies
+// decoded and rendered as they are for the log
+type sessionDetail struct {
+	Session
+	RequestBodyText  string `json:"requestBodyText,omitempty"`
+	ResponseBodyText string `json:"responseBodyText,omitempty"`
+}
+
+// uiServer serves the web UI for browsing the session store, pushing sessions to
+// the browser over server-sent events as they begin and finish
+type uiServer struct {
+	sessions *sessionStore
+	listen   string // host the UI listens on, for checking Host headers
+
+	mu      sync.Mutex
+	streams map[chan sessionSummary]struct{}
+}
+
+// newUIServer returns the UI's http.Server for addr. Event streams are ended when
+// the server shuts down, so they don't hold up the drain.
+func (p *Proxy) newUIServer(addr string) *http.Server {
+	ui := &uiServer{
+		sessions: p.sessions,
+		listen:   hostOnly(addr),
+		streams:  make(map[chan sessionSummary]struct{}),
+	}
+	p.sessions.observe(ui.publish)
+
+	static, _ := fs.Sub(uiFiles, "ui")
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	mux.HandleFunc("/api/sessions", ui.serveList)
+	mux.HandleFunc("/api/sessions/", ui.serveDetail)
+	mux.HandleFunc("/api/events", ui.serveEvents)
+	mux.HandleFunc("/api/export.har", p.sessions.serveHAR)
+	mux.HandleFunc("/api/export.saz", p.sessions.serveSAZ)
+	mux.HandleFunc("/api/pool", p.pool.serveStats)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           ui.checkHost(mux),
+		ReadHeaderTimeout: p.timeouts.idle,
+	}
+	server.RegisterOnShutdown(ui.closeStreams)
+	return server
+}
+
+// checkHost refuses requests naming a host other than the one the UI listens on,
+// so web pages can't read captured traffic through DNS rebinding
+func (ui *uiServer) checkHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := hostOnly(r.Host)
+		ip := net.ParseIP(host)
+		switch {
+		case ui.listen == "" || net.ParseIP(ui.listen).IsUnspecified():
+		case host == ui.listen || strings.EqualFold(host, "localhost") || (ip != nil && ip.IsLoopback()):
+		default:
+			http.Error(w, "unexpected Host", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveList serves the summaries of the sessions held, oldest first. With ?q=,
+// only sessions whose URL, headers or bodies contain it are listed.
+func (ui *uiServer) serveList(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	list := []sessionSummary{}
+	for _, s := range ui.sessions.list() {
+		if q == "" || sessionContains(s, q) {
+			list = append(list, summarize(s))
+		}
+	}
+	writeJSON(w, struct {
+		Sessions    []sessionSummary `json:"sessions"`
+		MaxSessions int              `json:"maxSessions"`
+	}{list, ui.sessions.maxCount})
+}
+
+// serveDetail serves /api/sessions/<id>
+func (ui *uiServer) serveDetail(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	s, ok := ui.sessions.get(id)
+	if !ok {
+		http.Error(w, "session not found; it may have been evicted", http.StatusNotFound)
+		return
+	}
+	detail := sessionDetail{Session: s}
+	if s.RequestBody.Size > 0 {
+		detail.RequestBodyText = renderCaptured(s.RequestBody.Data, s.RequestBody.Size, s.RequestHeader, uiBodyLimit)
+	}
+	if s.ResponseBody.Size > 0 {
+		detail.ResponseBodyText = renderCaptured(s.ResponseBody.Data, s.ResponseBody.Size, s.ResponseHeader, uiBodyLimit)
+	}
+	writeJSON(w, detail)
+}
+
+// serveEvents streams the summary of each session as it begins and finishes
+func (ui *uiServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events := make(chan sessionSummary, uiEventBuffer)
+	ui.mu.Lock()
+	ui.streams[events] = struct{}{}
+	ui.mu.Unlock()
+	defer ui.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// Tell the browser the stream is live, so it reloads the list it may have missed
+	fmt.Fprint(w, "event: ready\ndata: {}\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case sum, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(sum)
+			if _, err := fmt.Fprintf(w, "event: session\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// publish passes s to every open event stream. A stream too far behind is
+// closed rather than blocking the proxy.
+func (ui *uiServer) publish(s Session) {
+	sum := summarize(s)
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	for events := range ui.streams {
+		select {
+		case events <- sum:
+		default:
+			delete(ui.streams, events)
+			close(events)
+		}
+	}
+}
+
+func (ui *uiServer) unsubscribe(events chan sessionSummary) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	if _, ok := ui.streams[events]; ok {
+		delete(ui.streams, events)
+		close(events)
+	}
+}
+
+func (ui *uiServer) closeStreams() {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	for events := range ui.streams {
+		delete(ui.streams, events)
+		close(events)
+	}
+}
+
+// sessionContains reports whether the URL, headers or bodies of s contain q,
+// which is lower case. Bodies are searched decoded.
+func sessionContains(s Session, q string) bool {
+	if strings.Contains(strings.ToLower(s.Method+" "+s.URL), q) {
+		return true
+	}
+	for _, h := range []struct {
+		header http.Header
+		body   SessionBody
+	}{
+		{s.RequestHeader, s.RequestBody},
+		{s.ResponseHeader, s.ResponseBody},
+	} {
+		for key, values := range h.header {
+			for _, value := range values {
+				if strings.Contains(strings.ToLower(key+": "+value), q) {
+					return true
+				}
+			}
+		}
+		data := h.body.Data
+		if codings := contentCodings(h.header); len(codings) > 0 {
+			if decoded, _, err := decodeLimited(data, codings, uiBodyLimit); err == nil || len(decoded) > 0 {
+				data = decoded
+			}
+		}
+		if bytes.Contains(bytes.ToLower(data), []byte(q)) {
+			return true
+		}
+	}
+	for _, msg := range s.WebSocket {
+		if bytes.Contains(bytes.ToLower(msg.Payload), []byte(q)) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+// startUI listens on addr and serves the UI until the server is shut down
+func (p *Proxy) startUI(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := p.newUIServer(addr)
+	log.Printf("Serving the web UI on http://%s/\n", ln.Addr())
+	go server.Serve(ln)
+	return server, nil
+}
@@ -0,0 +1,294 @@
+'use strict';
+
+// Sessions known to the page by id, in the order they began
+const sessions = new Map();
+let maxSessions = 0;
+let selected = null;
+let tab = 'overview';
+let detail = null;
+let searchIDs = null; // ids matching the server-side search, null when not searching
+
+const $ = (id) => document.getElementById(id);
+const rows = $('rows');
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k === 'class') e.className = v;
+    else e.setAttribute(k, v);
+  }
+  for (const c of children) {
+    if (c != null) e.append(c);
+  }
+  return e;
+}
+
+function isSet(t) {
+  return t && !t.startsWith('0001-');
+}
+
+function formatSize(n) {
+  if (n < 1024) return n + ' B';
+  if (n < 1 << 20) return (n / 1024).toFixed(1) + ' KB';
+  return (n / (1 << 20)).toFixed(1) + ' MB';
+}
+
+function result(s) {
+  if (s.error) return 'error';
+  if (!s.done && !s.statusCode) return 'pending';
+  return String(s.statusCode || '');
+}
+
+// Row building and filtering
+
+function rowFor(s) {
+  const path = s.url.replace(/^[a-z]+:\/\/[^/]+/i, '') || s.url;
+  const type = (s.contentType || '').split(';')[0];
+  const tr = el('tr', { 'data-id': s.id, title: s.error || s.url },
+    el('td', null, String(s.id)),
+    el('td', null, result(s)),
+    el('td', null, s.method),
+    el('td', null, s.host),
+    el('td', null, path + (s.webSocket ? ' (' + s.webSocket + ' ws)' : '')),
+    el('td', null, type),
+    el('td', null, s.done ? formatSize(s.responseSize) : ''),
+    el('td', null, s.done ? s.duration.toFixed(0) + ' ms' : ''));
+  tr.className = s.error ? 'error' : (!s.done ? 'pending' : 's' + String(s.statusCode)[0]);
+  if (s.id === selected) tr.classList.add('selected');
+  tr.hidden = !matches(s);
+  return tr;
+}
+
+function matches(s) {
+  const text = $('filter').value.toLowerCase();
+  if (text && !(s.url + ' ' + (s.contentType || '')).toLowerCase().includes(text)) return false;
+  const method = $('method').value;
+  if (method && s.method !== method) return false;
+  const status = $('status').value;
+  if (status === 'error' && !s.error) return false;
+  if (status === 'pending' && s.done) return false;
+  if (/^\d$/.test(status) && String(s.statusCode)[0] !== status) return false;
+  if (searchIDs && !searchIDs.has(s.id)) return false;
+  return true;
+}
+
+function applyFilters() {
+  for (const tr of rows.children) {
+    tr.hidden = !matches(sessions.get(Number(tr.dataset.id)));
+  }
+}
+
+function addMethod(method) {
+  const select = $('method');
+  for (const o of select.options) {
+    if (o.value === method) return;
+  }
+  select.append(el('option', { value: method }, method));
+}
+
+function upsert(s) {
+  const old = sessions.get(s.id);
+  sessions.set(s.id, s);
+  addMethod(s.method);
+  const tr = rowFor(s);
+  const existing = old && rows.querySelector('tr[data-id="' + s.id + '"]');
+  if (existing) {
+    existing.replaceWith(tr);
+  } else {
+    const atBottom = $('list').scrollTop + $('list').clientHeight >= $('list').scrollHeight - 4;
+    rows.append(tr);
+    if (atBottom) $('list').scrollTop = $('list').scrollHeight;
+  }
+  // The store evicts the oldest sessions first; follow it
+  while (maxSessions > 0 && sessions.size > maxSessions) {
+    const oldest = sessions.keys().next().value;
+    sessions.delete(oldest);
+    rows.firstElementChild && rows.firstElementChild.remove();
+  }
+  if (s.id === selected && s.done) loadDetail(s.id);
+}
+
+async function loadList() {
+  const res = await fetch('api/sessions');
+  const body = await res.json();
+  maxSessions = body.maxSessions;
+  sessions.clear();
+  rows.textContent = '';
+  for (const s of body.sessions) upsert(s);
+}
+
+async function search() {
+  const q = $('search').value.trim();
+  if (!q) {
+    searchIDs = null;
+  } else {
+    const res = await fetch('api/sessions?q=' + encodeURIComponent(q));
+    const body = await res.json();
+    if ($('search').value.trim() !== q) return; // superseded
+    searchIDs = new Set(body.sessions.map((s) => s.id));
+  }
+  applyFilters();
+}
+
+// Detail view
+
+async function loadDetail(id) {
+  const res = await fetch('api/sessions/' + id);
+  if (id !== selected) return;
+  if (!res.ok) {
+    detail = null;
+    $('pane').replaceChildren(el('p', { class: 'error' }, await res.text()));
+    return;
+  }
+  detail = await res.json();
+  render();
+}
+
+function select(id) {
+  selected = id;
+  for (const tr of rows.querySelectorAll('tr.selected')) tr.classList.remove('selected');
+  const tr = rows.querySelector('tr[data-id="' + id + '"]');
+  if (tr) tr.classList.add('selected');
+  $('detail').hidden = false;
+  loadDetail(id);
+}
+
+function definitions(pairs) {
+  const dl = el('dl');
+  for (const [k, v] of pairs) {
+    if (v === undefined || v === null || v === '') continue;
+    dl.append(el('dt', null, k), el('dd', null, String(v)));
+  }
+  return dl;
+}
+
+function headerBlock(header) {
+  const lines = [];
+  for (const name of Object.keys(header || {}).sort()) {
+    for (const v of header[name]) lines.push(name + ': ' + v);
+  }
+  return el('pre', null, lines.join('\n') || '(none)');
+}
+
+function bodyBlock(text, body) {
+  if (!body || !body.size) return el('p', { class: 'muted' }, '(no body)');
+  const kept = body.data ? atob(body.data).length : 0;
+  const note = kept < body.size ? el('p', { class: 'muted' }, 'Kept ' + formatSize(kept) + ' of ' + formatSize(body.size)) : null;
+  return el('div', null, note, el('pre', null, text || ''));
+}
+
+function timingRows(t) {
+  const start = Date.parse(t.start);
+  const since = (v) => (isSet(v) ? (Date.parse(v) - start) + ' ms' : '');
+  return [
+    ['Started', isSet(t.start) ? new Date(start).toLocaleString() : ''],
+    ['Connected', since(t.gotConn)],
+    ['Request sent', since(t.requestSent)],
+    ['First byte', since(t.firstByte)],
+    ['Finished', since(t.end)],
+  ];
+}
+
+function renderOverview(d) {
+  const out = [el('h3', null, 'Transaction'), definitions([
+    ['URL', d.url],
+    ['Method', d.method],
+    ['Status', d.status || (d.done ? '' : 'pending')],
+    ['Client', d.clientAddr],
+    ['Tunnel', d.connectHost],
+    ['Scheme', d.scheme],
+    ['Protocol', d.requestProto + (d.responseProto && d.responseProto !== d.requestProto ? ' / ' + d.responseProto : '')],
+  ])];
+  if (d.error) {
+    out.push(el('h3', null, 'Error'), el('p', { class: 'error' }, d.error + (d.timeoutPhase ? ' (timed out: ' + d.timeoutPhase + ')' : '')));
+  }
+  out.push(el('h3', null, 'Timings'), definitions(timingRows(d.timings)));
+  if (d.tls) {
+    out.push(el('h3', null, 'TLS'), definitions([
+      ['Server name', d.tls.serverName],
+      ['Client version', d.tls.clientVersion],
+      ['Client cipher suite', d.tls.clientCipherSuite],
+      ['Client ALPN', d.tls.clientProtocol],
+      ['Upstream version', d.tls.upstreamVersion],
+      ['Upstream cipher suite', d.tls.upstreamCipherSuite],
+      ['Upstream ALPN', d.tls.upstreamProtocol],
+      ['Resumed', d.tls.upstreamVersion ? (d.tls.resumed ? 'yes' : 'no') : ''],
+      ['Verification error', d.tls.verifyError],
+    ]));
+  }
+  return out;
+}
+
+function renderMessage(d, which) {
+  const header = which === 'request' ? d.requestHeader : d.responseHeader;
+  const trailer = which === 'request' ? d.requestTrailer : d.responseTrailer;
+  const body = which === 'request' ? d.requestBody : d.responseBody;
+  const text = which === 'request' ? d.requestBodyText : d.responseBodyText;
+  if (which === 'response' && !d.statusCode) {
+    return [el('p', { class: 'muted' }, d.done ? 'No response was received.' : 'Waiting for the response.')];
+  }
+  const first = which === 'request' ? d.method + ' ' + d.url + ' ' + d.requestProto : d.responseProto + ' ' + d.status;
+  const out = [el('h3', null, first), headerBlock(header), el('h3', null, 'Body'), bodyBlock(text, body)];
+  if (trailer && Object.keys(trailer).length) out.push(el('h3', null, 'Trailers'), headerBlock(trailer));
+  return out;
+}
+
+function payloadText(msg) {
+  const raw = atob(msg.payload || '');
+  const bytes = Uint8Array.from(raw, (c) => c.charCodeAt(0));
+  if (msg.opcode === 1) return new TextDecoder().decode(bytes);
+  return Array.from(bytes, (b) => b.toString(16).padStart(2, '0')).join(' ');
+}
+
+const opcodes = { 0: 'continuation', 1: 'text', 2: 'binary', 8: 'close', 9: 'ping', 10: 'pong' };
+
+function renderWebSocket(d) {
+  if (!d.webSocket || !d.webSocket.length) return [el('p', { class: 'muted' }, '(no WebSocket messages)')];
+  const out = [];
+  for (const msg of d.webSocket) {
+    const flags = [opcodes[msg.opcode] || 'opcode ' + msg.opcode];
+    if (msg.compressed) flags.push('compressed');
+    if (msg.truncated) flags.push('truncated');
+    out.push(el('h3', null, (msg.direction === 'send' ? '→ ' : '← ') + new Date(msg.time).toLocaleTimeString() + ' ' + flags.join(', ')),
+      el('pre', null, payloadText(msg)));
+  }
+  return out;
+}
+
+function render() {
+  for (const b of $('tabs').children) b.classList.toggle('active', b.dataset.tab === tab);
+  if (!detail) return;
+  const views = { overview: renderOverview, request: (d) => renderMessage(d, 'request'), response: (d) => renderMessage(d, 'response'), websocket: renderWebSocket };
+  $('pane').replaceChildren(...views[tab](detail));
+}
+
+// Wiring
+
+rows.addEventListener('click', (e) => {
+  const tr = e.target.closest('tr');
+  if (tr) select(Number(tr.dataset.id));
+});
+$('tabs').addEventListener('click', (e) => {
+  if (e.target.dataset.tab) {
+    tab = e.target.dataset.tab;
+    render();
+  }
+});
+for (const id of ['filter', 'status', 'method']) $(id).addEventListener('input', applyFilters);
+let searchTimer;
+$('search').addEventListener('input', () => {
+  clearTimeout(searchTimer);
+  searchTimer = setTimeout(search, 300);
+});
+
+const events = new EventSource('api/events');
+events.addEventListener('ready', () => {
+  $('live').textContent = 'live';
+  $('live').classList.add('on');
+  loadList().then(search);
+});
+events.addEventListener('session', (e) => upsert(JSON.parse(e.data)));
+events.onerror = () => {
+  $('live').textContent = 'reconnecting';
+  $('live').classList.remove('on');
+};
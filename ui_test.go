@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUICheckHost(t *testing.T) {
+	tests := []struct {
+		listen string
+		host   string
+		want   int
+	}{
+		{"127.0.0.1:8889", "127.0.0.1:8889", http.StatusOK},
+		{"127.0.0.1:8889", "localhost:8889", http.StatusOK},
+		{"127.0.0.1:8889", "[::1]:8889", http.StatusOK},
+		// A name the attacker rebound to 127.0.0.1
+		{"127.0.0.1:8889", "evil.example:8889", http.StatusForbidden},
+		{"192.168.1.5:8889", "192.168.1.5:8889", http.StatusOK},
+		{"192.168.1.5:8889", "evil.example:8889", http.StatusForbidden},
+		{"0.0.0.0:8889", "evil.example:8889", http.StatusOK},
+		{":8889", "evil.example:8889", http.StatusOK},
+	}
+	for _, tt := range tests {
+		p := newTestProxy(t)
+		p.sessions = newSessionStore(10, 1<<20, 1<<20)
+		handler := p.newUIServer(tt.listen).Handler
+
+		req := httptest.NewRequest("GET", "/api/sessions", nil)
+		req.Host = tt.host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("UI on %s got status %d for Host %s, want %d", tt.listen, w.Code, tt.host, tt.want)
+		}
+	}
+}
+
+func TestUIAPI(t *testing.T) {
+	p := newTestProxy(t)
+	p.sessions = newSessionStore(10, 1<<20, 1<<20)
+	sessions := testSessions()
+	for i := range sessions {
+		p.sessions.add(&sessions[i])
+	}
+	handler := p.newUIServer(defaultUIAddr).Handler
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://"+defaultUIAddr+path, nil))
+		return w
+	}
+
+	var list struct {
+		Sessions []sessionSummary `json:"sessions"`
+	}
+	if err := json.NewDecoder(get("/api/sessions").Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Sessions) != len(testSessions()) || list.Sessions[0].Host != "example.com" {
+		t.Errorf("got sessions %+v", list.Sessions)
+	}
+	if err := json.NewDecoder(get("/api/sessions?q=compressed+page").Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Sessions) != 1 || list.Sessions[0].ID != 1 {
+		t.Errorf("search of decoded bodies got %+v", list.Sessions)
+	}
+
+	var detail sessionDetail
+	if err := json.NewDecoder(get("/api/sessions/1").Body).Decode(&detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.RequestBodyText != "a: 1\nb: 2" || !strings.Contains(detail.ResponseBodyText, "compressed page") {
+		t.Errorf("got request body %q, response body %q", detail.RequestBodyText, detail.ResponseBodyText)
+	}
+	if w := get("/api/sessions/99"); w.Code != http.StatusNotFound {
+		t.Errorf("missing session got status %d", w.Code)
+	}
+	if w := get("/api/sessions/x"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid session id got status %d", w.Code)
+	}
+
+	w := get("/api/pool")
+	var stats map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&stats); w.Code != http.StatusOK || err != nil {
+		t.Errorf("pool statistics got status %d, %v", w.Code, err)
+	}
+}
+
+// TestUIEvents checks a transaction through the proxy is pushed to an open event
+// stream as it begins and once it is done
+func TestUIEvents(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	p, proxyAddr := startTestProxy(t, nil)
+	p.sessions = newSessionStore(10, 1<<20, 1<<20)
+	ui := httptest.NewServer(p.newUIServer(defaultUIAddr).Handler)
+	defer ui.Close()
+
+	resp, err := http.Get(ui.URL + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got Content-Type %q", ct)
+	}
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		sc := bufio.NewScanner(resp.Body)
+		var event string
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				events <- event + " " + strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	next := func() string {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return ""
+		}
+	}
+	if e := next(); e != "ready {}" {
+		t.Fatalf("got first event %q", e)
+	}
+
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	got, err := client.Get(upstream.URL + "/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, got.Body)
+	got.Body.Close()
+
+	for _, wantDone := range []bool{false, true} {
+		e := next()
+		name, data, _ := strings.Cut(e, " ")
+		var sum sessionSummary
+		if err := json.Unmarshal([]byte(data), &sum); name != "session" || err != nil {
+			t.Fatalf("got event %q", e)
+		}
+		if sum.URL != upstream.URL+"/page" || sum.Done != wantDone {
+			t.Errorf("got %+v, want done=%v", sum, wantDone)
+		}
+		if wantDone && (sum.StatusCode != http.StatusOK || sum.ResponseSize != 5) {
+			t.Errorf("finished session got %+v", sum)
+		}
+	}
+}
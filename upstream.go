@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Ways of reporting an upstream certificate which failed verification to the client
+const (
+	// verifyFailureUntrusted presents a certificate signed by newUntrustedCA, so the
+	// client rejects the connection just as it would have rejected the real server
+	verifyFailureUntrusted = "untrusted"
+	// verifyFailureError presents a trusted certificate, then answers with an error page
+	verifyFailureError = "error"
+)
+
+// loadUpstreamRoots returns the system roots plus the certificates in caFile,
+// or nil to use just the system roots when caFile is empty
+func loadUpstreamRoots(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream CA bundle: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// verifyUpstream checks the certificate chain presented by the target server the
+// same way crypto/tls would, unless the server is listed in -insecure-hosts
+func (p *Proxy) verifyUpstream(state tls.ConnectionState, serverName string) error {
+	if p.insecureHosts.Match(serverName) {
+		return nil
+	}
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         p.upstreamRoots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// serveVerifyError answers the client's first request with an error page explaining
+// why the target server's certificate was rejected, then closes the connection
+func serveVerifyError(client net.Conn, host string, verifyErr error) {
+	req, err := http.ReadRequest(bufio.NewReader(client))
+	if err != nil {
+		return
+	}
+	log.Printf("HTTPS %s https://%s%s rejected: upstream certificate failed verification\n", req.Method, host, req.URL)
+
+	body := fmt.Sprintf(`<!DOCTYPE html>
+<html><head><title>Upstream certificate rejected</title></head>
+<body><h1>Upstream certificate rejected</h1>
+<p>NetMiddler did not forward this request because the certificate presented by <b>%s</b> failed verification:</p>
+<pre>%s</pre>
+<p>To intercept this host anyway, add it to <code>-insecure-hosts</code>.</p>
+</body></html>
+`, html.EscapeString(host), html.EscapeString(verifyErr.Error()))
+
+	resp := &http.Response{
+		StatusCode:    http.StatusBadGateway,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Request:       req,
+	}
+	resp.Write(client)
+}
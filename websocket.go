@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WebSocket opcodes (RFC 6455 section 5.2)
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// Directions of a WebSocketMessage, named as in browser HAR exports
+const (
+	wsSend    = "send"    // client to server
+	wsReceive = "receive" // server to client
+)
+
+// maxWSMessage caps how much of a message is kept for inspection; frames are
+// always relayed in full regardless
+const maxWSMessage = 16 << 20
+
+// deflateWindow is the largest LZ77 window permessage-deflate can use
+const deflateWindow = 1 << 15
+
+// WebSocketMessage is one message or control frame relayed over a WebSocket
+type WebSocketMessage struct {
+	Direction  string    `json:"direction"`
+	Opcode     byte      `json:"opcode"`
+	Time       time.Time `json:"time"`
+	Payload    []byte    `json:"payload,omitempty"` // decompressed when permessage-deflate was used
+	Compressed bool      `json:"compressed"`
+	Truncated  bool      `json:"truncated"` // Payload holds only the first maxWSMessage bytes
+}
+
+// isWebSocketUpgrade reports whether resp accepted a WebSocket handshake
+func isWebSocketUpgrade(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusSwitchingProtocols &&
+		strings.EqualFold(resp.Header.Get("Upgrade"), "websocket")
+}
+
+// errInvalidFrame is returned for a frame which breaks RFC 6455
+var errInvalidFrame = errors.New("invalid WebSocket frame")
+
+// relayWebSocket relays frames between client and upstream until both directions
+// are done, decoding a copy of each direction into messages. The bytes forwarded
+// are exactly those received, whatever the decoder makes of them.
+func relayWebSocket(url string, resp *http.Response, client io.WriteCloser, clientReader io.Reader, upstream io.WriteCloser, upstreamReader io.Reader, idle time.Duration, rec *recording) error {
+	log.Printf("WebSocket %s opened\n", url)
+	deflate := parseWSDeflate(resp.Header)
+
+	sent, received := deflate.inflater(wsSend), deflate.inflater(wsReceive)
+	err := tunnel(client, upstream, idle,
+		func(dst io.Writer) error { return copyWebSocket(dst, clientReader, url, wsSend, sent, rec) },
+		func(dst io.Writer) error { return copyWebSocket(dst, upstreamReader, url, wsReceive, received, rec) })
+
+	log.Printf("WebSocket %s closed\n", url)
+	return err
+}
+
+// copyWebSocket forwards src to dst while decoding the frames which pass through,
+// logging and recording each message
+func copyWebSocket(dst io.Writer, src io.Reader, url, direction string, inflater *wsInflater, rec *recording) error {
+	// Everything the decoder reads is forwarded as soon as it arrives
+	r := bufio.NewReader(io.TeeReader(src, dst))
+
+	var msg *WebSocketMessage
+	for {
+		frame, err := readWSFrame(r)
+		if errors.Is(err, errInvalidFrame) {
+			log.Printf("WebSocket %s: failed to decode %s frame: %v\n", url, direction, err)
+			// Keep relaying even though the stream can no longer be decoded
+			_, err = io.Copy(io.Discard, r)
+			return err
+		} else if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Control frames may arrive between the fragments of a message
+		if frame.opcode >= wsClose {
+			control := &WebSocketMessage{
+				Direction: direction,
+				Opcode:    frame.opcode,
+				Time:      time.Now(),
+				Payload:   frame.payload,
+			}
+			logWebSocketMessage(url, control)
+			rec.webSocketMessage(control)
+			continue
+		}
+
+		if frame.opcode != wsContinuation {
+			msg = &WebSocketMessage{
+				Direction:  direction,
+				Opcode:     frame.opcode,
+				Time:       time.Now(),
+				Compressed: frame.rsv1 && inflater != nil,
+			}
+		} else if msg == nil {
+			log.Printf("WebSocket %s: unexpected %s continuation frame\n", url, direction)
+			continue
+		}
+		msg.Truncated = msg.Truncated || frame.truncated
+		if room := maxWSMessage - len(msg.Payload); room < len(frame.payload) {
+			msg.Payload = append(msg.Payload, frame.payload[:room]...)
+			msg.Truncated = true
+		} else {
+			msg.Payload = append(msg.Payload, frame.payload...)
+		}
+		if !frame.fin {
+			continue
+		}
+
+		if msg.Compressed {
+			if msg.Truncated {
+				// A partial message can't be inflated, and breaks the shared window too
+				inflater.reset()
+			} else {
+				var truncated bool
+				if msg.Payload, truncated, err = inflater.inflate(msg.Payload); err != nil {
+					log.Printf("WebSocket %s: failed to inflate %s message: %v\n", url, direction, err)
+				}
+				msg.Truncated = truncated
+			}
+		}
+		logWebSocketMessage(url, msg)
+		rec.webSocketMessage(msg)
+		msg = nil
+	}
+}
+
+// logWebSocketMessage logs a decoded message, including its payload with -print-body
+func logWebSocketMessage(url string, msg *WebSocketMessage) {
+	arrow := "->"
+	if msg.Direction == wsReceive {
+		arrow = "<-"
+	}
+	desc := fmt.Sprintf("%d bytes", len(msg.Payload))
+	if msg.Truncated {
+		desc += ", truncated"
+	}
+	if msg.Compressed {
+		desc += ", compressed"
+	}
+	if msg.Opcode == wsClose && len(msg.Payload) >= 2 {
+		desc = fmt.Sprintf("code %d %q", binary.BigEndian.Uint16(msg.Payload), msg.Payload[2:])
+	}
+	log.Printf("WebSocket %s %s %s (%s)\n", url, arrow, wsOpcodeName(msg.Opcode), desc)
+
+	if printBody && len(msg.Payload) > 0 && msg.Opcode != wsClose {
+		payload, contentType := msg.Payload, ""
+		if msg.Opcode != wsText {
+			contentType = "application/octet-stream"
+		}
+		if len(payload) > printBodyLimit {
+			payload = payload[:printBodyLimit]
+		}
+		body := renderBody(payload, contentType)
+		if len(payload) < len(msg.Payload) {
+			body += fmt.Sprintf("\n[truncated: printed the first %d of %d bytes]", len(payload), len(msg.Payload))
+		}
+		log.Printf("WebSocket Body:\n%s\n", body)
+	}
+}
+
+func wsOpcodeName(opcode byte) string {
+	switch opcode {
+	case wsContinuation:
+		return "continuation"
+	case wsText:
+		return "text"
+	case wsBinary:
+		return "binary"
+	case wsClose:
+		return "close"
+	case wsPing:
+		return "ping"
+	case wsPong:
+		return "pong"
+	}
+	return fmt.Sprintf("opcode 0x%x", opcode)
+}
+
+// wsFrame is a single decoded frame, with its payload unmasked
+type wsFrame struct {
+	fin       bool
+	rsv1      bool
+	opcode    byte
+	payload   []byte
+	truncated bool
+}
+
+// encodeWSFrame returns a single unmasked frame carrying payload
+func encodeWSFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	return append(frame, payload...)
+}
+
+// readWSFrame reads one frame (RFC 6455 section 5.2)
+func readWSFrame(r *bufio.Reader) (*wsFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	frame := &wsFrame{
+		fin:    header[0]&0x80 != 0,
+		rsv1:   header[0]&0x40 != 0,
+		opcode: header[0] & 0x0F,
+	}
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if frame.opcode >= wsClose && (length > 125 || !frame.fin) {
+		return nil, fmt.Errorf("%w: control frame too long or fragmented", errInvalidFrame)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep up to maxWSMessage of the payload and skip the rest
+	keep := length
+	if keep > maxWSMessage {
+		keep = maxWSMessage
+		frame.truncated = true
+	}
+	frame.payload = make([]byte, keep)
+	if _, err := io.ReadFull(r, frame.payload); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(length-keep)); err != nil {
+		return nil, err
+	}
+	if masked {
+		for i := range frame.payload {
+			frame.payload[i] ^= mask[i%4]
+		}
+	}
+	return frame, nil
+}
+
+// wsDeflate holds the negotiated permessage-deflate parameters (RFC 7692)
+type wsDeflate struct {
+	enabled                 bool
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+}
+
+// parseWSDeflate reads the extensions the server accepted in its handshake response
+func parseWSDeflate(h http.Header) wsDeflate {
+	var d wsDeflate
+	for _, ext := range strings.Split(strings.Join(h.Values("Sec-WebSocket-Extensions"), ","), ",") {
+		params := strings.Split(ext, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		d.enabled = true
+		for _, param := range params[1:] {
+			switch name, _, _ := strings.Cut(strings.TrimSpace(param), "="); name {
+			case "server_no_context_takeover":
+				d.serverNoContextTakeover = true
+			case "client_no_context_takeover":
+				d.clientNoContextTakeover = true
+			}
+		}
+	}
+	return d
+}
+
+// inflater returns the decompressor for messages sent in direction, or nil
+func (d wsDeflate) inflater(direction string) *wsInflater {
+	if !d.enabled {
+		return nil
+	}
+	if direction == wsSend {
+		return &wsInflater{noContextTakeover: d.clientNoContextTakeover}
+	}
+	return &wsInflater{noContextTakeover: d.serverNoContextTakeover}
+}
+
+// wsInflater decompresses the messages of one direction. Unless context takeover
+// is disabled, each message may refer back to the output of earlier ones, so the
+// last window of output is kept as the dictionary for the next message.
+type wsInflater struct {
+	noContextTakeover bool
+	window            []byte
+}
+
+// inflate decompresses a message, keeping at most maxWSMessage bytes of it and
+// reporting whether there was more. A message inflating past the limit leaves the
+// window unknown, so the inflater is reset as for a message it could not inflate.
+func (f *wsInflater) inflate(data []byte) ([]byte, bool, error) {
+	// Senders strip the trailing empty block of the sync flush that ends each message
+	tail := []byte{0x00, 0x00, 0xff, 0xff}
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(data), bytes.NewReader(tail)), f.window)
+	out, err := io.ReadAll(io.LimitReader(r, maxWSMessage+1))
+	// The stream has no final block, so running out of input is expected
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	if err != nil {
+		f.reset()
+		return data, false, err
+	}
+	if len(out) > maxWSMessage {
+		f.reset()
+		return out[:maxWSMessage], true, nil
+	}
+
+	if !f.noContextTakeover {
+		f.window = append(f.window, out...)
+		if len(f.window) > deflateWindow {
+			f.window = append([]byte(nil), f.window[len(f.window)-deflateWindow:]...)
+		}
+	}
+	return out, false, nil
+}
+
+// reset forgets the shared window after a message which could not be inflated
+func (f *wsInflater) reset() {
+	f.window = nil
+}
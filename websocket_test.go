@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// maskedFrame encodes a frame as a client sends it, with its payload masked
+func maskedFrame(fin bool, opcode byte, payload []byte) []byte {
+	frame := encodeWSFrame(opcode, nil)[:1]
+	if !fin {
+		frame[0] &^= 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestReadWSFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		opcode  byte
+		fin     bool
+		payload []byte
+		err     error
+	}{
+		{"empty", encodeWSFrame(wsText, nil), wsText, true, []byte{}, nil},
+		{"unmasked", encodeWSFrame(wsBinary, []byte{1, 2, 3}), wsBinary, true, []byte{1, 2, 3}, nil},
+		{"masked", maskedFrame(true, wsText, []byte("hello")), wsText, true, []byte("hello"), nil},
+		{"fragment", maskedFrame(false, wsText, []byte("he")), wsText, false, []byte("he"), nil},
+		{"16-bit length", encodeWSFrame(wsBinary, bytes.Repeat([]byte{7}, 300)), wsBinary, true, bytes.Repeat([]byte{7}, 300), nil},
+		{"64-bit length", maskedFrame(true, wsBinary, bytes.Repeat([]byte{9}, 70000)), wsBinary, true, bytes.Repeat([]byte{9}, 70000), nil},
+		{"long control frame", encodeWSFrame(wsPing, make([]byte, 126)), 0, false, nil, errInvalidFrame},
+		{"fragmented control frame", maskedFrame(false, wsPing, nil), 0, false, nil, errInvalidFrame},
+		{"short header", []byte{0x81}, 0, false, nil, io.ErrUnexpectedEOF},
+		{"short payload", encodeWSFrame(wsText, []byte("hello"))[:4], 0, false, nil, io.ErrUnexpectedEOF},
+		{"short extended length", []byte{0x82, 127, 0, 0}, 0, false, nil, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := readWSFrame(bufio.NewReader(bytes.NewReader(tt.data)))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.opcode != tt.opcode || frame.fin != tt.fin || !bytes.Equal(frame.payload, tt.payload) {
+				t.Errorf("got opcode %d fin %v payload %d bytes, want opcode %d fin %v payload %d bytes",
+					frame.opcode, frame.fin, len(frame.payload), tt.opcode, tt.fin, len(tt.payload))
+			}
+		})
+	}
+}
+
+// deflateMessages compresses each message as permessage-deflate does, sharing one
+// compressor across messages unless noContextTakeover is set
+func deflateMessages(t *testing.T, noContextTakeover bool, messages ...string) [][]byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	var out [][]byte
+	for _, msg := range messages {
+		if noContextTakeover {
+			w.Reset(&buf)
+		}
+		w.Write([]byte(msg))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.TrimSuffix(buf.Bytes(), []byte{0x00, 0x00, 0xff, 0xff})
+		out = append(out, append([]byte(nil), data...))
+		buf.Reset()
+	}
+	return out
+}
+
+func TestWSInflater(t *testing.T) {
+	messages := []string{"the quick brown fox", "the quick brown fox jumps", "over the lazy dog"}
+	for _, noContextTakeover := range []bool{false, true} {
+		inflater := &wsInflater{noContextTakeover: noContextTakeover}
+		for i, data := range deflateMessages(t, noContextTakeover, messages...) {
+			out, truncated, err := inflater.inflate(data)
+			if err != nil || truncated {
+				t.Fatalf("noContextTakeover=%v message %d: truncated %v, error %v", noContextTakeover, i, truncated, err)
+			}
+			if string(out) != messages[i] {
+				t.Errorf("noContextTakeover=%v message %d: got %q, want %q", noContextTakeover, i, out, messages[i])
+			}
+		}
+	}
+
+	if _, _, err := (&wsInflater{}).inflate([]byte{0xff, 0xff, 0xff}); err == nil {
+		t.Error("inflating garbage succeeded")
+	}
+}
+
+// TestWSInflaterLimit inflates a small message expanding past maxWSMessage
+func TestWSInflaterLimit(t *testing.T) {
+	bomb := deflateMessages(t, false, strings.Repeat("\x00", maxWSMessage+1000))
+	inflater := &wsInflater{}
+	out, truncated, err := inflater.inflate(bomb[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated || len(out) != maxWSMessage {
+		t.Errorf("got %d bytes, truncated %v; want %d bytes, truncated", len(out), truncated, maxWSMessage)
+	}
+	if inflater.window != nil {
+		t.Error("the window was kept after a truncated message")
+	}
+}
+
+func TestParseWSDeflate(t *testing.T) {
+	tests := []struct {
+		header string
+		want   wsDeflate
+	}{
+		{"", wsDeflate{}},
+		{"x-webkit-deflate-frame", wsDeflate{}},
+		{"permessage-deflate", wsDeflate{enabled: true}},
+		{"permessage-deflate; server_no_context_takeover; client_max_window_bits=15", wsDeflate{enabled: true, serverNoContextTakeover: true}},
+		{"foo, permessage-deflate;client_no_context_takeover", wsDeflate{enabled: true, clientNoContextTakeover: true}},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.header != "" {
+			h.Set("Sec-WebSocket-Extensions", tt.header)
+		}
+		if got := parseWSDeflate(h); got != tt.want {
+			t.Errorf("parseWSDeflate(%q) = %+v, want %+v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCopyWebSocket(t *testing.T) {
+	compressed := deflateMessages(t, false, "squeezed")[0]
+	compressedFrame := maskedFrame(true, wsText, compressed)
+	compressedFrame[0] |= 0x40 // RSV1 marks a compressed message
+
+	var stream []byte
+	stream = append(stream, maskedFrame(false, wsText, []byte("hel"))...)
+	stream = append(stream, maskedFrame(true, wsPing, []byte("p"))...)
+	stream = append(stream, maskedFrame(true, wsContinuation, []byte("lo"))...)
+	stream = append(stream, compressedFrame...)
+	stream = append(stream, maskedFrame(true, wsClose, []byte{0x03, 0xe8})...)
+
+	st := newSessionStore(10, 1<<20, 1<<20)
+	rec := st.begin(httptest.NewRequest("GET", "http://example.com/ws", nil), "http")
+	var relayed bytes.Buffer
+	if err := copyWebSocket(&relayed, bytes.NewReader(stream), "ws://example.com/ws", wsSend, &wsInflater{}, rec); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(relayed.Bytes(), stream) {
+		t.Error("relayed bytes differ from those read")
+	}
+
+	s, _ := st.get(rec.session.ID)
+	want := []struct {
+		opcode  byte
+		payload string
+	}{
+		{wsPing, "p"},
+		{wsText, "hello"},
+		{wsText, "squeezed"},
+		{wsClose, "\x03\xe8"},
+	}
+	if len(s.WebSocket) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(s.WebSocket), len(want))
+	}
+	for i, w := range want {
+		if msg := s.WebSocket[i]; msg.Opcode != w.opcode || string(msg.Payload) != w.payload || msg.Direction != wsSend {
+			t.Errorf("message %d: got %s %d %q, want %d %q", i, msg.Direction, msg.Opcode, msg.Payload, w.opcode, w.payload)
+		}
+	}
+}
+
+func TestCopyWebSocketInvalidFrame(t *testing.T) {
+	// Undecodable input is still relayed in full
+	stream := append(encodeWSFrame(wsPing, make([]byte, 200)), "trailing garbage"...)
+	var relayed bytes.Buffer
+	if err := copyWebSocket(&relayed, bytes.NewReader(stream), "ws://example.com/ws", wsReceive, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(relayed.Bytes(), stream) {
+		t.Errorf("relayed %d bytes, want %d", relayed.Len(), len(stream))
+	}
+}